@@ -273,1174 +273,1711 @@ import (
 
 const MAX_REGISTRATIONS = 128
 
+// fMap is read from the exported functions below, which may be invoked by a
+// VM on one goroutine while another goroutine registers new functions, so
+// every access to fMap and its bookkeeping must hold fMapGuard.
 var (
 	fMap      = make(map[int]func())
-	fMapGuard sync.Mutex
+	fIndex    = make(map[unsafe.Pointer]int)
+	fFree     []int
+	fMapGuard sync.RWMutex
 	counter   int
 )
 
 //export f0
 func f0(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[0]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 0 not registered")
+		missingFunc(vm, 0)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f1
 func f1(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[1]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 1 not registered")
+		missingFunc(vm, 1)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f2
 func f2(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[2]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 2 not registered")
+		missingFunc(vm, 2)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f3
 func f3(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[3]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 3 not registered")
+		missingFunc(vm, 3)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f4
 func f4(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[4]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 4 not registered")
+		missingFunc(vm, 4)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f5
 func f5(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[5]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 5 not registered")
+		missingFunc(vm, 5)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f6
 func f6(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[6]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 6 not registered")
+		missingFunc(vm, 6)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f7
 func f7(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[7]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 7 not registered")
+		missingFunc(vm, 7)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f8
 func f8(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[8]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 8 not registered")
+		missingFunc(vm, 8)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f9
 func f9(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[9]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 9 not registered")
+		missingFunc(vm, 9)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f10
 func f10(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[10]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 10 not registered")
+		missingFunc(vm, 10)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f11
 func f11(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[11]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 11 not registered")
+		missingFunc(vm, 11)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f12
 func f12(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[12]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 12 not registered")
+		missingFunc(vm, 12)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f13
 func f13(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[13]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 13 not registered")
+		missingFunc(vm, 13)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f14
 func f14(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[14]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 14 not registered")
+		missingFunc(vm, 14)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f15
 func f15(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[15]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 15 not registered")
+		missingFunc(vm, 15)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f16
 func f16(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[16]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 16 not registered")
+		missingFunc(vm, 16)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f17
 func f17(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[17]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 17 not registered")
+		missingFunc(vm, 17)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f18
 func f18(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[18]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 18 not registered")
+		missingFunc(vm, 18)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f19
 func f19(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[19]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 19 not registered")
+		missingFunc(vm, 19)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f20
 func f20(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[20]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 20 not registered")
+		missingFunc(vm, 20)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f21
 func f21(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[21]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 21 not registered")
+		missingFunc(vm, 21)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f22
 func f22(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[22]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 22 not registered")
+		missingFunc(vm, 22)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f23
 func f23(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[23]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 23 not registered")
+		missingFunc(vm, 23)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f24
 func f24(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[24]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 24 not registered")
+		missingFunc(vm, 24)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f25
 func f25(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[25]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 25 not registered")
+		missingFunc(vm, 25)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f26
 func f26(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[26]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 26 not registered")
+		missingFunc(vm, 26)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f27
 func f27(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[27]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 27 not registered")
+		missingFunc(vm, 27)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f28
 func f28(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[28]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 28 not registered")
+		missingFunc(vm, 28)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f29
 func f29(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[29]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 29 not registered")
+		missingFunc(vm, 29)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f30
 func f30(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[30]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 30 not registered")
+		missingFunc(vm, 30)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f31
 func f31(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[31]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 31 not registered")
+		missingFunc(vm, 31)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f32
 func f32(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[32]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 32 not registered")
+		missingFunc(vm, 32)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f33
 func f33(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[33]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 33 not registered")
+		missingFunc(vm, 33)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f34
 func f34(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[34]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 34 not registered")
+		missingFunc(vm, 34)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f35
 func f35(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[35]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 35 not registered")
+		missingFunc(vm, 35)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f36
 func f36(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[36]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 36 not registered")
+		missingFunc(vm, 36)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f37
 func f37(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[37]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 37 not registered")
+		missingFunc(vm, 37)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f38
 func f38(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[38]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 38 not registered")
+		missingFunc(vm, 38)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f39
 func f39(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[39]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 39 not registered")
+		missingFunc(vm, 39)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f40
 func f40(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[40]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 40 not registered")
+		missingFunc(vm, 40)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f41
 func f41(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[41]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 41 not registered")
+		missingFunc(vm, 41)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f42
 func f42(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[42]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 42 not registered")
+		missingFunc(vm, 42)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f43
 func f43(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[43]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 43 not registered")
+		missingFunc(vm, 43)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f44
 func f44(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[44]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 44 not registered")
+		missingFunc(vm, 44)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f45
 func f45(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[45]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 45 not registered")
+		missingFunc(vm, 45)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f46
 func f46(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[46]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 46 not registered")
+		missingFunc(vm, 46)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f47
 func f47(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[47]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 47 not registered")
+		missingFunc(vm, 47)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f48
 func f48(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[48]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 48 not registered")
+		missingFunc(vm, 48)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f49
 func f49(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[49]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 49 not registered")
+		missingFunc(vm, 49)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f50
 func f50(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[50]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 50 not registered")
+		missingFunc(vm, 50)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f51
 func f51(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[51]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 51 not registered")
+		missingFunc(vm, 51)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f52
 func f52(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[52]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 52 not registered")
+		missingFunc(vm, 52)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f53
 func f53(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[53]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 53 not registered")
+		missingFunc(vm, 53)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f54
 func f54(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[54]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 54 not registered")
+		missingFunc(vm, 54)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f55
 func f55(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[55]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 55 not registered")
+		missingFunc(vm, 55)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f56
 func f56(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[56]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 56 not registered")
+		missingFunc(vm, 56)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f57
 func f57(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[57]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 57 not registered")
+		missingFunc(vm, 57)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f58
 func f58(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[58]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 58 not registered")
+		missingFunc(vm, 58)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f59
 func f59(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[59]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 59 not registered")
+		missingFunc(vm, 59)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f60
 func f60(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[60]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 60 not registered")
+		missingFunc(vm, 60)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f61
 func f61(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[61]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 61 not registered")
+		missingFunc(vm, 61)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f62
 func f62(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[62]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 62 not registered")
+		missingFunc(vm, 62)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f63
 func f63(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[63]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 63 not registered")
+		missingFunc(vm, 63)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f64
 func f64(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[64]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 64 not registered")
+		missingFunc(vm, 64)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f65
 func f65(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[65]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 65 not registered")
+		missingFunc(vm, 65)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f66
 func f66(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[66]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 66 not registered")
+		missingFunc(vm, 66)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f67
 func f67(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[67]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 67 not registered")
+		missingFunc(vm, 67)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f68
 func f68(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[68]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 68 not registered")
+		missingFunc(vm, 68)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f69
 func f69(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[69]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 69 not registered")
+		missingFunc(vm, 69)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f70
 func f70(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[70]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 70 not registered")
+		missingFunc(vm, 70)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f71
 func f71(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[71]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 71 not registered")
+		missingFunc(vm, 71)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f72
 func f72(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[72]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 72 not registered")
+		missingFunc(vm, 72)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f73
 func f73(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[73]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 73 not registered")
+		missingFunc(vm, 73)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f74
 func f74(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[74]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 74 not registered")
+		missingFunc(vm, 74)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f75
 func f75(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[75]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 75 not registered")
+		missingFunc(vm, 75)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f76
 func f76(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[76]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 76 not registered")
+		missingFunc(vm, 76)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f77
 func f77(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[77]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 77 not registered")
+		missingFunc(vm, 77)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f78
 func f78(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[78]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 78 not registered")
+		missingFunc(vm, 78)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f79
 func f79(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[79]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 79 not registered")
+		missingFunc(vm, 79)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f80
 func f80(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[80]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 80 not registered")
+		missingFunc(vm, 80)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f81
 func f81(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[81]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 81 not registered")
+		missingFunc(vm, 81)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f82
 func f82(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[82]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 82 not registered")
+		missingFunc(vm, 82)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f83
 func f83(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[83]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 83 not registered")
+		missingFunc(vm, 83)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f84
 func f84(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[84]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 84 not registered")
+		missingFunc(vm, 84)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f85
 func f85(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[85]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 85 not registered")
+		missingFunc(vm, 85)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f86
 func f86(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[86]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 86 not registered")
+		missingFunc(vm, 86)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f87
 func f87(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[87]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 87 not registered")
+		missingFunc(vm, 87)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f88
 func f88(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[88]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 88 not registered")
+		missingFunc(vm, 88)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f89
 func f89(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[89]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 89 not registered")
+		missingFunc(vm, 89)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f90
 func f90(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[90]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 90 not registered")
+		missingFunc(vm, 90)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f91
 func f91(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[91]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 91 not registered")
+		missingFunc(vm, 91)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f92
 func f92(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[92]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 92 not registered")
+		missingFunc(vm, 92)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f93
 func f93(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[93]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 93 not registered")
+		missingFunc(vm, 93)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f94
 func f94(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[94]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 94 not registered")
+		missingFunc(vm, 94)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f95
 func f95(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[95]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 95 not registered")
+		missingFunc(vm, 95)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f96
 func f96(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[96]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 96 not registered")
+		missingFunc(vm, 96)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f97
 func f97(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[97]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 97 not registered")
+		missingFunc(vm, 97)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f98
 func f98(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[98]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 98 not registered")
+		missingFunc(vm, 98)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f99
 func f99(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[99]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 99 not registered")
+		missingFunc(vm, 99)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f100
 func f100(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[100]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 100 not registered")
+		missingFunc(vm, 100)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f101
 func f101(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[101]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 101 not registered")
+		missingFunc(vm, 101)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f102
 func f102(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[102]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 102 not registered")
+		missingFunc(vm, 102)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f103
 func f103(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[103]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 103 not registered")
+		missingFunc(vm, 103)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f104
 func f104(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[104]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 104 not registered")
+		missingFunc(vm, 104)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f105
 func f105(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[105]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 105 not registered")
+		missingFunc(vm, 105)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f106
 func f106(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[106]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 106 not registered")
+		missingFunc(vm, 106)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f107
 func f107(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[107]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 107 not registered")
+		missingFunc(vm, 107)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f108
 func f108(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[108]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 108 not registered")
+		missingFunc(vm, 108)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f109
 func f109(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[109]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 109 not registered")
+		missingFunc(vm, 109)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f110
 func f110(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[110]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 110 not registered")
+		missingFunc(vm, 110)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f111
 func f111(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[111]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 111 not registered")
+		missingFunc(vm, 111)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f112
 func f112(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[112]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 112 not registered")
+		missingFunc(vm, 112)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f113
 func f113(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[113]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 113 not registered")
+		missingFunc(vm, 113)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f114
 func f114(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[114]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 114 not registered")
+		missingFunc(vm, 114)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f115
 func f115(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[115]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 115 not registered")
+		missingFunc(vm, 115)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f116
 func f116(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[116]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 116 not registered")
+		missingFunc(vm, 116)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f117
 func f117(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[117]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 117 not registered")
+		missingFunc(vm, 117)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f118
 func f118(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[118]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 118 not registered")
+		missingFunc(vm, 118)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f119
 func f119(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[119]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 119 not registered")
+		missingFunc(vm, 119)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f120
 func f120(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[120]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 120 not registered")
+		missingFunc(vm, 120)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f121
 func f121(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[121]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 121 not registered")
+		missingFunc(vm, 121)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f122
 func f122(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[122]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 122 not registered")
+		missingFunc(vm, 122)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f123
 func f123(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[123]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 123 not registered")
+		missingFunc(vm, 123)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f124
 func f124(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[124]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 124 not registered")
+		missingFunc(vm, 124)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f125
 func f125(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[125]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 125 not registered")
+		missingFunc(vm, 125)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f126
 func f126(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[126]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 126 not registered")
+		missingFunc(vm, 126)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 //export f127
 func f127(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[127]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function 127 not registered")
+		missingFunc(vm, 127)
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 
 func registerFunc(name string, f func()) (unsafe.Pointer, error) {
-	if (counter + 1) >= MAX_REGISTRATIONS {
-		return nil, errors.New("maximum function registration reached")
+	fMapGuard.Lock()
+	defer fMapGuard.Unlock()
+
+	var i int
+	if n := len(fFree); n > 0 {
+		i, fFree = fFree[n-1], fFree[:n-1]
+	} else {
+		if (counter + 1) >= MAX_REGISTRATIONS {
+			return nil, errors.New("maximum function registration reached")
+		}
+		i = counter
+		counter++
 	}
 
+	fMap[i] = f
+	ptr := C.get_f(C.int(i))
+	fIndex[ptr] = i
+	return ptr, nil
+}
+
+// unregisterFunc releases the function registered at ptr, making its index
+// available to future registrations.
+func unregisterFunc(ptr unsafe.Pointer) {
 	fMapGuard.Lock()
 	defer fMapGuard.Unlock()
 
-	fMap[counter] = f
-	ptr := C.get_f(C.int(counter))
-	counter++
-	return ptr, nil
+	if i, ok := fIndex[ptr]; ok {
+		delete(fMap, i)
+		delete(fIndex, ptr)
+		fFree = append(fFree, i)
+	}
 }
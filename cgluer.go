@@ -31,35 +31,64 @@ import (
 
 const MAX_REGISTRATIONS = {{len .}}
 
+// fMap is read from the exported functions below, which may be invoked by a
+// VM on one goroutine while another goroutine registers new functions, so
+// every access to fMap and its bookkeeping must hold fMapGuard.
 var (
 	fMap = make(map[int]func())
-	fMapGuard sync.Mutex
+	fIndex = make(map[unsafe.Pointer]int)
+	fFree []int
+	fMapGuard sync.RWMutex
 	counter int
 )
 
 {{range .}}
 //export f{{.}}
 func f{{.}}(vm unsafe.Pointer) {
+	fMapGuard.RLock()
 	f := fMap[{{.}}]
+	fMapGuard.RUnlock()
 	if f == nil {
-		panic("function {{.}} not registered")
+		missingFunc(vm, {{.}})
+		return
 	}
+	defer recoverFunc(vm)
 	f()
 }
 {{end}}
 
 func registerFunc(name string, f func()) (unsafe.Pointer, error) {
-	if (counter+1) >= MAX_REGISTRATIONS {
-		return nil, errors.New("maximum function registration reached")
+	fMapGuard.Lock()
+	defer fMapGuard.Unlock()
+
+	var i int
+	if n := len(fFree); n > 0 {
+		i, fFree = fFree[n-1], fFree[:n-1]
+	} else {
+		if (counter+1) >= MAX_REGISTRATIONS {
+			return nil, errors.New("maximum function registration reached")
+		}
+		i = counter
+		counter++
 	}
 
+	fMap[i] = f
+	ptr := C.get_f(C.int(i))
+	fIndex[ptr] = i
+	return ptr, nil
+}
+
+// unregisterFunc releases the function registered at ptr, making its index
+// available to future registrations.
+func unregisterFunc(ptr unsafe.Pointer) {
 	fMapGuard.Lock()
 	defer fMapGuard.Unlock()
 
-	fMap[counter] = f
-	ptr := C.get_f(C.int(counter))
-	counter++
-	return ptr, nil
+	if i, ok := fIndex[ptr]; ok {
+		delete(fMap, i)
+		delete(fIndex, ptr)
+		fFree = append(fFree, i)
+	}
 }
 `))
 
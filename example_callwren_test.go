@@ -16,6 +16,7 @@ func Example_callWren() {
 	`
 
 	vm := wren.NewVM()
+	defer vm.Close()
 	if err := vm.Interpret(program); err != nil {
 		panic(err)
 	}
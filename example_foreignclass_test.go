@@ -37,8 +37,13 @@ func Example_foreignClass() {
 
 	// Initialize the virtual machine and register the foreign class/method.
 	vm := wren.NewVM()
-	vm.RegisterForeignClass("God", NewGod)
-	vm.RegisterForeignMethod("God.getMessage(_)", GetGodsMessage)
+	defer vm.Close()
+	if err := vm.RegisterForeignClass("God", NewGod); err != nil {
+		panic(err)
+	}
+	if err := vm.RegisterForeignMethod("God.getMessage(_)", GetGodsMessage); err != nil {
+		panic(err)
+	}
 
 	if err := vm.Interpret(program); err != nil {
 		panic(err)
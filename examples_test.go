@@ -10,6 +10,7 @@ func ExampleWrenVM_Interpret() {
 	`
 
 	vm := wren.NewVM()
+	defer vm.Close()
 	if err := vm.Interpret(program); err != nil {
 		panic(err)
 	}
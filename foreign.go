@@ -0,0 +1,351 @@
+package wren
+
+import "strings"
+
+// Foreign methods can't call back into Wren, so they have no way to list the keys of a
+// map passed to them. Methods with parameters that need them are therefore called
+// through a Wren method that's declared in place of the foreign one, which gathers up
+// the keys and passes them along to GoForeign.invoke_ with the arguments. That's done
+// by rewriting the declarations in the source of each module before Wren compiles it.
+
+// wrenToken is a token of Wren source, as far as wrapForeign needs to tell them apart:
+// comments and spaces are skipped, each newline is a token of its own, and a string is a
+// single token, along with any expressions interpolated into it.
+type wrenToken struct {
+	text       string
+	start, end int
+}
+
+// wrenOperators are the operators that a method can be declared for, longest first.
+var wrenOperators = []string{
+	"...", "..", "<=", ">=", "==", "!=", "<<", ">>",
+	"+", "-", "*", "/", "%", "<", ">", "&", "|", "^", "!", "~",
+}
+
+// lexWren splits Wren source into tokens.
+func lexWren(src string) []wrenToken {
+	var tokens []wrenToken
+	for i := 0; i < len(src); {
+		start := i
+		switch c := src[i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(src[i:], "/*"):
+			i = skipBlockComment(src, i)
+			continue
+		case c == '"':
+			i = skipString(src, i)
+		case isNameChar(c):
+			for i < len(src) && (isNameChar(src[i]) || src[i] == '.' && i+1 < len(src) && isDigit(src[i+1]) && isDigit(src[start])) {
+				i++
+			}
+		default:
+			i++
+			for _, op := range wrenOperators {
+				if strings.HasPrefix(src[start:], op) {
+					i = start + len(op)
+					break
+				}
+			}
+		}
+		tokens = append(tokens, wrenToken{src[start:i], start, i})
+	}
+	return tokens
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isName reports whether a token is a name, which could also be a keyword.
+func isName(text string) bool {
+	return text != "" && isNameChar(text[0]) && !isDigit(text[0])
+}
+
+// skipBlockComment returns the index just past the block comment starting at src[i].
+// Block comments nest.
+func skipBlockComment(src string, i int) int {
+	depth := 0
+	for i < len(src) {
+		switch {
+		case strings.HasPrefix(src[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(src[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// skipString returns the index just past the string starting at src[i], including any
+// expressions interpolated into it with %(...), which may contain strings of their own.
+func skipString(src string, i int) int {
+	if strings.HasPrefix(src[i:], `"""`) {
+		if end := strings.Index(src[i+3:], `"""`); end >= 0 {
+			return i + 3 + end + 3
+		}
+		return len(src)
+	}
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		case '%':
+			if i+1 < len(src) && src[i+1] == '(' {
+				i = skipInterpolation(src, i+2) - 1
+			}
+		}
+	}
+	return len(src)
+}
+
+// skipInterpolation returns the index just past the parenthesis closing an expression
+// interpolated into a string, which starts at src[i].
+func skipInterpolation(src string, i int) int {
+	for depth := 1; i < len(src); i++ {
+		switch src[i] {
+		case '"':
+			i = skipString(src, i) - 1
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(src)
+}
+
+// wrenMember is the declaration of a foreign method or a constructor in a class body.
+type wrenMember struct {
+	signature string   // The method's Wren signature, such as "name(_,_)"
+	static    bool     // Whether it's declared static
+	params    []string // The names of its parameters
+	decl      int      // The index of the token starting the declaration proper
+	end       int      // The index of the token just past it
+}
+
+// parseForeignMember parses the declaration of a foreign method starting at the
+// "foreign" keyword in tokens[i], returning false if it isn't one that wrapForeign knows
+// how to wrap, such as one spread across several lines.
+func parseForeignMember(tokens []wrenToken, i int) (wrenMember, bool) {
+	m := wrenMember{}
+	i++
+	if i < len(tokens) && tokens[i].text == "static" {
+		m.static = true
+		i++
+	}
+	if i >= len(tokens) {
+		return m, false
+	}
+	m.decl = i
+	var ok bool
+	switch text := tokens[i].text; {
+	case isName(text):
+		i++
+		switch {
+		case i+1 < len(tokens) && tokens[i].text == "=" && tokens[i+1].text == "(":
+			if m.params, i, ok = parseParams(tokens, i+1, ")"); !ok || len(m.params) != 1 {
+				return m, false
+			}
+			m.signature = text + "=(_)"
+		case i < len(tokens) && tokens[i].text == "(":
+			if m.params, i, ok = parseParams(tokens, i, ")"); !ok {
+				return m, false
+			}
+			m.signature = text + "(" + placeholders(len(m.params)) + ")"
+		default:
+			m.signature = text
+		}
+	case text == "[":
+		if m.params, i, ok = parseParams(tokens, i, "]"); !ok || len(m.params) == 0 {
+			return m, false
+		}
+		m.signature = "[" + placeholders(len(m.params)) + "]"
+		if i+1 < len(tokens) && tokens[i].text == "=" && tokens[i+1].text == "(" {
+			var value []string
+			if value, i, ok = parseParams(tokens, i+1, ")"); !ok || len(value) != 1 {
+				return m, false
+			}
+			m.params = append(m.params, value...)
+			m.signature += "=(_)"
+		}
+	case isOperator(text):
+		i++
+		if i < len(tokens) && tokens[i].text == "(" {
+			if m.params, i, ok = parseParams(tokens, i, ")"); !ok || len(m.params) != 1 {
+				return m, false
+			}
+			m.signature = text + "(_)"
+		} else {
+			m.signature = text
+		}
+	default:
+		return m, false
+	}
+	m.end = i
+	return m, endsMember(tokens, i)
+}
+
+// parseConstructor parses the declaration of a constructor with an empty body starting
+// at the "construct" keyword in tokens[i], returning false if it isn't one.
+func parseConstructor(tokens []wrenToken, i int) (wrenMember, bool) {
+	m := wrenMember{decl: i + 1}
+	if i+2 >= len(tokens) || !isName(tokens[i+1].text) || tokens[i+2].text != "(" {
+		return m, false
+	}
+	params, j, ok := parseParams(tokens, i+2, ")")
+	if !ok || j+1 >= len(tokens) || tokens[j].text != "{" || tokens[j+1].text != "}" {
+		return m, false
+	}
+	m.params, m.end = params, j+2
+	return m, endsMember(tokens, m.end)
+}
+
+// parseParams parses a list of parameter names starting at the opening bracket in
+// tokens[i] and ending with close, returning the names and the index of the token
+// following the list.
+func parseParams(tokens []wrenToken, i int, close string) ([]string, int, bool) {
+	var params []string
+	i++
+	if i < len(tokens) && tokens[i].text == close {
+		return params, i + 1, true
+	}
+	for i+1 < len(tokens) && isName(tokens[i].text) {
+		params = append(params, tokens[i].text)
+		switch tokens[i+1].text {
+		case ",":
+			i += 2
+		case close:
+			return params, i + 2, true
+		default:
+			return nil, i, false
+		}
+	}
+	return nil, i, false
+}
+
+// endsMember reports whether tokens[i] ends a member of a class body, as the end of
+// its line or of the class does.
+func endsMember(tokens []wrenToken, i int) bool {
+	return i >= len(tokens) || tokens[i].text == "\n" || tokens[i].text == "}"
+}
+
+func isOperator(text string) bool {
+	for _, op := range wrenOperators {
+		if text == op {
+			return true
+		}
+	}
+	return false
+}
+
+// placeholders returns n underscores separated by commas, as in a Wren signature.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("_,", n), ",")
+}
+
+// wrenString quotes s as a Wren string literal.
+func wrenString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `%`, `\%`).Replace(s) + `"`
+}
+
+// wrapForeign rewrites source so that each of the foreign methods declared in it whose
+// function needs the shapes of its arguments, as recorded by setShaped, is declared as
+// a Wren method instead, calling GoForeign.call_ with its arguments. Constructors with
+// empty bodies in foreign classes whose constructor functions need them are rewritten
+// the same way, as static methods. Each declaration is rewritten in place, so that the
+// lines of the source don't move. wrapForeign returns false if nothing was rewritten.
+func (vm *VM) wrapForeign(source string) (string, bool) {
+	if len(vm.shaped) == 0 {
+		return source, false
+	}
+
+	// A class body is a frame holding the class's name; other braces have none.
+	type frame struct {
+		class   string
+		foreign bool
+	}
+	var (
+		tokens  = lexWren(source)
+		out     strings.Builder
+		copied  int
+		stack   []frame
+		pending frame
+	)
+	for i, lineStart := 0, true; i < len(tokens); i++ {
+		text := tokens[i].text
+		atMember := lineStart && len(stack) > 0 && stack[len(stack)-1].class != ""
+		lineStart = text == "\n"
+		switch text {
+		case "{":
+			stack = append(stack, pending)
+			pending = frame{}
+			lineStart = true
+		case "}":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case "class":
+			if i+1 < len(tokens) && isName(tokens[i+1].text) {
+				pending = frame{class: tokens[i+1].text, foreign: i > 0 && tokens[i-1].text == "foreign"}
+			}
+		case "foreign", "construct":
+			if !atMember {
+				continue
+			}
+			class := stack[len(stack)-1]
+			var (
+				m    wrenMember
+				ok   bool
+				name string
+				decl string
+			)
+			if text == "foreign" {
+				if m, ok = parseForeignMember(tokens, i); !ok {
+					continue
+				}
+				name = class.class + "." + m.signature
+				if m.static {
+					name = "static " + name
+				}
+				decl = source[tokens[i+1].start:tokens[m.end-1].end]
+			} else {
+				if m, ok = parseConstructor(tokens, i); !ok || !class.foreign {
+					continue
+				}
+				name = class.class
+				decl = "static " + source[tokens[m.decl].start:tokens[m.end-3].end]
+			}
+			if _, ok := vm.shaped[name]; !ok {
+				continue
+			}
+			out.WriteString(source[copied:tokens[i].start])
+			out.WriteString(decl)
+			out.WriteString(" { GoForeign.call_(" + wrenString(name) + ", this, [" + strings.Join(m.params, ", ") + "]) }")
+			copied = tokens[m.end-1].end
+			i = m.end - 1
+		}
+	}
+	if copied == 0 {
+		return source, false
+	}
+	out.WriteString(source[copied:])
+	return out.String(), true
+}
@@ -0,0 +1,69 @@
+package wren
+
+// Pool is a set of virtual machines that can be shared between goroutines. A single
+// VM isn't safe for concurrent use, so a server running scripts on behalf of many
+// requests should take a VM from the pool for each request and return it when done.
+//
+// Every foreign method and class that a VM registers takes up one of a fixed number of
+// slots shared by the whole process, MAX_REGISTRATIONS (128 unless cglue.go is
+// regenerated with a different number), until the VM is closed. A pool whose setup
+// registers n foreign methods can therefore only have about 128/n VMs alive at once,
+// counting both those handed out by Get and those held idle; once the slots run out,
+// Get fails. The pool holds on to a limited number of idle VMs, closing any others
+// returned to it, so that the ones it doesn't need give their slots back.
+type Pool struct {
+	setup func(*VM) error
+	idle  chan *VM
+}
+
+// NewPool creates a new pool of virtual machines, which holds on to at most size idle
+// VMs. setup is run on each newly created virtual machine, and should perform any
+// registrations that every VM in the pool needs; if it fails, the VM is closed and Get
+// returns the error.
+func NewPool(size int, setup func(*VM) error) *Pool {
+	if size < 0 {
+		size = 0
+	}
+	return &Pool{setup: setup, idle: make(chan *VM, size)}
+}
+
+// Get takes a virtual machine from the pool, creating a new one if none are idle.
+func (p *Pool) Get() (*VM, error) {
+	select {
+	case vm := <-p.idle:
+		return vm, nil
+	default:
+	}
+	vm := NewVM()
+	if p.setup != nil {
+		if err := p.setup(vm); err != nil {
+			vm.Close()
+			return nil, err
+		}
+	}
+	return vm, nil
+}
+
+// Put returns a virtual machine to the pool. Any state left behind by scripts run on
+// it, such as top-level variables, will be visible to the next user of the VM. If the
+// pool already holds as many idle VMs as it can, the VM is closed instead.
+func (p *Pool) Put(vm *VM) {
+	select {
+	case p.idle <- vm:
+	default:
+		vm.Close()
+	}
+}
+
+// Close closes all of the idle virtual machines in the pool. Those still in use are
+// unaffected, and the pool can still be used afterwards.
+func (p *Pool) Close() {
+	for {
+		select {
+		case vm := <-p.idle:
+			vm.Close()
+		default:
+			return
+		}
+	}
+}
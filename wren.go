@@ -23,6 +23,24 @@
 // However, it's also possible to register foreign classes and methods in Go that can
 // be called from Wren, and to execute Wren code directly from Go.
 //
+// Numbers
+//
+// Wren has a single number type, a double-precision float. Go integers passed to Wren
+// are converted to float64, so integers with a magnitude greater than 2^53 lose
+// precision on the way in. Going the other way, a foreign method whose parameter is an
+// integer type will refuse (by failing the call) any number larger than 2^53, outside
+// the range of the parameter's type, or with a fractional part, rather than silently
+// passing it a rounded or truncated value. The same goes for NaN and the infinities,
+// which pass freely between Wren and Go floats but have no integer equivalent.
+//
+// Strings
+//
+// Strings pass between Go and Wren byte for byte, including any NUL bytes, but Wren
+// assumes that they hold UTF-8: indexing, iterating over and counting a string that
+// isn't valid UTF-8 may give surprising results. Binary data is better passed as a
+// []byte, which becomes a list of numbers, one per byte. Source code is assumed to be
+// UTF-8 as well; see ValidateUTF8 for checking it before it's run.
+//
 // Foreign Function Limits
 //
 // Due to Go's inability to generate C-exported functions at runtime, the number of
@@ -37,82 +55,546 @@ package wren
 // #cgo LDFLAGS: -L${SRCDIR}/wren/lib -lwren -lm
 // #include <wren.h>
 //
+// #if !defined(WREN_VERSION_NUMBER) || WREN_VERSION_NUMBER < 4000
+// #error "go-wren needs Wren 0.4.0 or later; check out the 0.4.0 tag in the wren submodule"
+// #endif
+//
 // extern void write(WrenVM*, char*);
 // extern void* bindMethod(WrenVM*, char*, char*, bool, char*);
 // extern WrenForeignClassMethods bindClass(WrenVM*, char*, char*);
 // extern void writeErr(WrenVM*, WrenErrorType, char* module, int line, char* message);
-// extern char* loadModule(WrenVM*, char*);
+// extern char* resolveModule(WrenVM*, char*, char*);
+// extern WrenLoadModuleResult loadModule(WrenVM*, char*);
+// extern void finalizeRef(void*);
+// extern void allocateUnregistered(WrenVM*);
+//
+// static inline void freeModuleSource(WrenVM* vm, const char* name, WrenLoadModuleResult result) {
+// 	free((void*)result.source);
+// }
+//
+// // goWrenData is the user data of every VM, holding the JSON-encoded settings
+// // read by loadModule and statistics about the VM's memory use.
+// typedef struct {
+// 	char* json;
+// 	long long allocated;
+// 	long long peak;
+// 	long long collections;
+// 	int sentinelArmed;
+// } goWrenData;
+//
+// // Each allocation is prefixed by a header recording its size, so that the
+// // allocator knows how much is being freed. It's 16 bytes to preserve alignment.
+// #define GO_WREN_ALLOC_HEADER 16
+//
+// static void* goWrenReallocate(void* memory, size_t newSize, void* userData) {
+// 	goWrenData* data = (goWrenData*)userData;
+// 	char* block = NULL;
+// 	size_t oldSize = 0;
+// 	if (memory != NULL) {
+// 		block = (char*)memory - GO_WREN_ALLOC_HEADER;
+// 		oldSize = *(size_t*)block;
+// 	}
+// 	if (newSize == 0) {
+// 		free(block);
+// 		data->allocated -= (long long)oldSize;
+// 		return NULL;
+// 	}
+// 	block = (char*)realloc(block, newSize + GO_WREN_ALLOC_HEADER);
+// 	if (block == NULL) {
+// 		return NULL;
+// 	}
+// 	*(size_t*)block = newSize;
+// 	data->allocated += (long long)newSize - (long long)oldSize;
+// 	if (data->allocated > data->peak) {
+// 		data->peak = data->allocated;
+// 	}
+// 	return block + GO_WREN_ALLOC_HEADER;
+// }
+//
+// // A GC sentinel is an unreachable foreign object whose finalizer records that a
+// // garbage collection happened, since Wren doesn't report collections itself.
+// static void goWrenSentinelAllocate(WrenVM* vm) {
+// 	goWrenData** data = (goWrenData**)wrenSetSlotNewForeign(vm, 0, 0, sizeof(goWrenData*));
+// 	*data = (goWrenData*)wrenGetUserData(vm);
+// }
+//
+// static void goWrenSentinelFinalize(void* memory) {
+// 	goWrenData* data = *(goWrenData**)memory;
+// 	data->collections++;
+// 	data->sentinelArmed = 0;
+// }
 import "C"
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 	"unsafe"
 )
 
 var (
-	vmMap     = make(map[*C.WrenVM]*VM)
-	errWriter io.Writer
+	vmMap      = make(map[*C.WrenVM]*VM)
+	vmMapGuard sync.RWMutex
+	errWriter  io.Writer
 )
 
+// lookupVM returns the VM wrapping the given C virtual machine, or nil if it has
+// been closed.
+func lookupVM(vm *C.WrenVM) *VM {
+	vmMapGuard.RLock()
+	defer vmMapGuard.RUnlock()
+	return vmMap[vm]
+}
+
+// ErrReentrant is returned when Wren code is run from inside a foreign method, which
+// Wren doesn't support. A foreign method that needs to run more Wren code should
+// arrange for it to be run after the current Interpret or Call returns instead.
+var ErrReentrant = errors.New("cannot interpret while a Wren call is in progress")
+
 // VM is a single instance of a Wren virtual machine.
 type VM struct {
 	vm               *C.WrenVM
+	mainModule       *C.char
 	classes, methods map[string]unsafe.Pointer
 	userData         map[string]interface{}
-	userDataPtr      unsafe.Pointer
+	data             map[string]interface{}
+	refs             map[unsafe.Pointer]interface{}
+	refClasses       map[string]bool
+	classModules     map[string]string
+	foreignTypes     map[reflect.Type]string
+	internal         map[string]unsafe.Pointer
+	bound, retired   map[unsafe.Pointer]bool
+	shaped           map[string]interface{}
+	preluded         map[string]bool
+	skipWrapper      bool
+	handles          map[*C.WrenHandle]bool
+	handleGuard      sync.Mutex
+	generation       uint64
+	loaded           map[string]bool
+	importers        map[string]string
+	cdata            *C.goWrenData
+	moduleFS         fs.FS
 	outWriter        io.Writer
+	teeWriters       []io.Writer
+	stdoutBuf        []byte
+	outputLimit      int64
+	outputCount      int64
+	outputExceeded   bool
+	callbackErr      error
+	outFunc          func(string)
+	errFunc          func(errType, module string, line int, msg string)
+	displayName      string
+	beforeCall       func(method string)
+	afterCall        func(method string, elapsed time.Duration, err error)
+	debug            bool
+	jsonTags         bool
+	useStringers     bool
+	preferIntegers   bool
+	optionalResults  bool
+	strictFields     bool
+	strictArity      bool
+	validateUTF8     bool
+	running          bool
+	clock            func() float64
+	env              map[string]bool
+	tickInstalled    bool
+	lastValue        *Value
+	objectClass      *Value
+	sameCall         *CallHandle
+	insertedAt       int
+	inserted         int
+	source           *C.char
+	sourceModule     string
+	compileErr       *CompileError
+	runtimeErr       *RuntimeError
+	importErr        error
+	resolveErr       string
+	maxImportDepth   int
+	keepSources      bool
+	sources          map[string]string
+	lastErrorKind    ErrorKind
+	sandboxed        bool
+	sourceTransform  func(module, source string) string
+	gcTracking       bool
+	gcHook           func(stats VMStats)
+	gcSeen           int64
+	aborted          int32
+	interrupted      bool
 }
 
-// NewVM creates a new Wren virtual machine.
-func NewVM() *VM {
+// newCData allocates the user data for a new C virtual machine.
+func newCData() *C.goWrenData {
+	return (*C.goWrenData)(C.calloc(1, C.sizeof_goWrenData))
+}
+
+// newCVM creates a new C virtual machine wired up to this package's callbacks,
+// with the given user data.
+func newCVM(cdata *C.goWrenData) *C.WrenVM {
 	var config C.WrenConfiguration
 	C.wrenInitConfiguration(&config)
 
+	config.reallocateFn = C.WrenReallocateFn(C.goWrenReallocate)
+	config.userData = unsafe.Pointer(cdata)
+
 	config.writeFn = C.WrenWriteFn(C.write)
 	config.bindForeignMethodFn = C.WrenBindForeignMethodFn(C.bindMethod)
 	config.bindForeignClassFn = C.WrenBindForeignClassFn(C.bindClass)
 	config.errorFn = C.WrenErrorFn(C.writeErr)
+	config.resolveModuleFn = C.WrenResolveModuleFn(C.resolveModule)
 	config.loadModuleFn = C.WrenLoadModuleFn(C.loadModule)
 
-	vm := VM{vm: C.wrenNewVM(&config)}
+	return C.wrenNewVM(&config)
+}
+
+// NewSandboxVM creates a new Wren virtual machine for running untrusted scripts.
+//
+// Scripts running in a sandboxed virtual machine can't import any modules, even if
+// a modules directory or filesystem is set, and the only foreign methods and classes
+// available to them are those the host registers explicitly, so they can't reach
+// anything outside of the virtual machine that the host doesn't hand them.
+func NewSandboxVM() *VM {
+	vm := NewVM()
+	vm.sandboxed = true
+	return vm
+}
+
+// NewVM creates a new Wren virtual machine.
+func NewVM() *VM {
+	cdata := newCData()
+	vm := VM{vm: newCVM(cdata), cdata: cdata, mainModule: C.CString("main")}
 	vm.classes = make(map[string]unsafe.Pointer)
 	vm.methods = make(map[string]unsafe.Pointer)
 	vm.userData = make(map[string]interface{})
+	vm.data = make(map[string]interface{})
+	vm.refs = make(map[unsafe.Pointer]interface{})
+	vm.refClasses = make(map[string]bool)
+	vm.classModules = make(map[string]string)
+	vm.foreignTypes = make(map[reflect.Type]string)
+	vm.internal = make(map[string]unsafe.Pointer)
+	vm.bound = make(map[unsafe.Pointer]bool)
+	vm.retired = make(map[unsafe.Pointer]bool)
+	vm.shaped = make(map[string]interface{})
+	vm.preluded = make(map[string]bool)
+	vm.handles = make(map[*C.WrenHandle]bool)
+	vm.loaded = make(map[string]bool)
+	vm.importers = make(map[string]string)
+	vmMapGuard.Lock()
 	vmMap[vm.vm] = &vm
-	runtime.SetFinalizer(&vm, func(vm *VM) {
-		C.wrenFreeVM(vm.vm)
-		delete(vmMap, vm.vm)
-	})
+	vmMapGuard.Unlock()
 
 	return &vm
 }
 
+// Close frees the virtual machine along with any C memory it holds, releasing any
+// handles held by Values and CallHandles that are still around, and unregisters its
+// foreign methods and classes so that others can take their place under the limit on
+// registrations. The virtual machine must not be used after calling Close, but calling
+// Close more than once is safe. Values and CallHandles belonging to it return ErrClosed
+// from then on, even once a new virtual machine has taken its place in memory, as do
+// Interpret and its variants.
+//
+// Close must be called once the virtual machine is no longer needed. The package keeps
+// track of every open virtual machine, so that the callbacks Wren makes can find it,
+// which means that one that's never closed is never garbage collected either; its
+// memory and its registrations would be held until the program exits.
+func (vm *VM) Close() {
+	if vm.vm == nil {
+		return
+	}
+	vmMapGuard.Lock()
+	delete(vmMap, vm.vm)
+	vmMapGuard.Unlock()
+	vm.releaseHandles(vm.vm)
+	C.wrenFreeVM(vm.vm)
+	unregistered := make(map[unsafe.Pointer]bool)
+	for _, ptrs := range []map[string]unsafe.Pointer{vm.methods, vm.classes, vm.internal} {
+		for name, ptr := range ptrs {
+			// Aliases share a pointer, which must only be unregistered once, or
+			// it could free the same slot after another VM has reused it.
+			if !unregistered[ptr] {
+				unregisterFunc(ptr)
+				unregistered[ptr] = true
+			}
+			delete(ptrs, name)
+		}
+	}
+	vm.freeRetired()
+	C.free(unsafe.Pointer(vm.cdata.json))
+	C.free(unsafe.Pointer(vm.cdata))
+	C.free(unsafe.Pointer(vm.mainModule))
+	vm.vm, vm.cdata, vm.mainModule = nil, nil, nil
+	vm.refs = make(map[unsafe.Pointer]interface{})
+}
+
+// BytesAllocated returns the number of bytes of memory currently allocated by the
+// virtual machine for Wren objects and its own bookkeeping. Memory held by Go values,
+// such as those behind RegisterForeignClassRef, isn't included.
+func (vm *VM) BytesAllocated() int64 {
+	if vm.cdata == nil {
+		return 0
+	}
+	return int64(vm.cdata.allocated)
+}
+
+// VMStats describes a virtual machine's memory use.
+type VMStats struct {
+	// BytesAllocated is the number of bytes currently allocated, as returned by
+	// BytesAllocated.
+	BytesAllocated int64
+	// PeakBytesAllocated is the largest number of bytes allocated at any one time.
+	PeakBytesAllocated int64
+	// Collections is the number of garbage collections observed since SetGCHook was
+	// first called, and always zero if it never was.
+	Collections int64
+}
+
+// Stats returns statistics about the virtual machine's memory use.
+func (vm *VM) Stats() VMStats {
+	if vm.cdata == nil {
+		return VMStats{}
+	}
+	return VMStats{
+		BytesAllocated:     int64(vm.cdata.allocated),
+		PeakBytesAllocated: int64(vm.cdata.peak),
+		Collections:        int64(vm.cdata.collections),
+	}
+}
+
+// gcModule is the module holding the class of the sentinels used to observe garbage
+// collections.
+const gcModule = "go-wren/gc"
+
+// SetGCHook starts counting the virtual machine's garbage collections, whether run by
+// GC or by Wren on its own, and sets a function to be called with the virtual
+// machine's stats after each one. hook may be nil to only count collections.
+//
+// Wren doesn't report its collections, so they're observed by leaving an unreachable
+// object lying around and noting when it's finalized. A new one is only put in place
+// once Interpret or Call returns or the script calls a foreign method, so several
+// collections in between are counted as one, and hook is only called once Interpret
+// or Call returns, or from GC. SetGCHook must not be called from within a foreign
+// method the first time it's used on a virtual machine.
+func (vm *VM) SetGCHook(hook func(stats VMStats)) error {
+	vm.gcHook = hook
+	if vm.gcTracking {
+		return nil
+	}
+	if err := vm.LoadOnce(gcModule, "foreign class GCSentinel {}\n"); err != nil {
+		return err
+	}
+	vm.gcTracking = true
+	vm.gcSeen = int64(vm.cdata.collections)
+	vm.armGCSentinel()
+	return nil
+}
+
+// armGCSentinel creates an unreachable GC sentinel, whose finalizer records the next
+// garbage collection, unless there already is one.
+func (vm *VM) armGCSentinel() {
+	if !vm.gcTracking || vm.cdata.sentinelArmed != 0 || !vm.loaded[gcModule] {
+		return
+	}
+	c_module := C.CString(gcModule)
+	defer C.free(unsafe.Pointer(c_module))
+	c_className := C.CString("GCSentinel")
+	defer C.free(unsafe.Pointer(c_className))
+
+	scratch := scratchSlots(vm.vm, 2)
+	C.wrenGetVariable(vm.vm, c_module, c_className, C.int(scratch))
+	data := (**C.goWrenData)(C.wrenSetSlotNewForeign(vm.vm, C.int(scratch+1), C.int(scratch), C.size_t(unsafe.Sizeof(vm.cdata))))
+	*data = vm.cdata
+	C.wrenSetSlotNull(vm.vm, C.int(scratch+1))
+	vm.cdata.sentinelArmed = 1
+}
+
+// observeGC re-arms the GC sentinel and calls the GC hook if there's been a garbage
+// collection since it was last called.
+func (vm *VM) observeGC() {
+	if !vm.gcTracking {
+		return
+	}
+	vm.armGCSentinel()
+	if collections := int64(vm.cdata.collections); collections != vm.gcSeen {
+		vm.gcSeen = collections
+		if vm.gcHook != nil {
+			vm.gcHook(vm.Stats())
+		}
+	}
+}
+
+// trackHandle records a handle belonging to the given virtual machine, so that it can
+// be released when the virtual machine is closed or reset if it hasn't been already.
+func trackHandle(vm *C.WrenVM, h *C.WrenHandle) *C.WrenHandle {
+	if v := lookupVM(vm); v != nil && h != nil {
+		v.handleGuard.Lock()
+		v.handles[h] = true
+		v.handleGuard.Unlock()
+	}
+	return h
+}
+
+// vmRef identifies the virtual machine that a Value or CallHandle belongs to. Once a
+// C virtual machine is freed, its address may be reused by a new one, so rather than
+// looking the C virtual machine up again, a vmRef holds on to the VM itself along with
+// its generation, which changes whenever the C virtual machine is closed or reset.
+type vmRef struct {
+	owner *VM
+	gen   uint64
+	vm    *C.WrenVM
+}
+
+// refVM returns a vmRef for the given C virtual machine, which must be open.
+func refVM(vm *C.WrenVM) vmRef {
+	owner := lookupVM(vm)
+	return vmRef{owner: owner, gen: owner.generation, vm: vm}
+}
+
+// live returns the VM referred to, or nil if its C virtual machine has since been
+// closed or reset.
+func (r vmRef) live() *VM {
+	if r.owner == nil || r.owner.vm != r.vm || r.owner.generation != r.gen {
+		return nil
+	}
+	return r.owner
+}
+
+// releaseHandle releases a handle recorded by trackHandle. It does nothing if the
+// handle has already been released, including by its virtual machine being closed
+// or reset, so it's safe to call from finalizers.
+func (r vmRef) releaseHandle(h *C.WrenHandle) {
+	if r.owner == nil {
+		return
+	}
+	r.owner.handleGuard.Lock()
+	defer r.owner.handleGuard.Unlock()
+	if r.owner.generation == r.gen && r.owner.handles[h] {
+		delete(r.owner.handles, h)
+		C.wrenReleaseHandle(r.vm, h)
+	}
+}
+
+// releaseHandles releases every handle still outstanding on the given C virtual
+// machine, which is about to be freed; Wren expects them all to be released first.
+// It also starts a new generation, so that Values and CallHandles made before can
+// tell that they're no longer usable.
+func (vm *VM) releaseHandles(c *C.WrenVM) {
+	vm.handleGuard.Lock()
+	defer vm.handleGuard.Unlock()
+	for h := range vm.handles {
+		C.wrenReleaseHandle(c, h)
+	}
+	vm.handles = make(map[*C.WrenHandle]bool)
+	vm.generation++
+}
+
+// ErrClosed is returned when using a virtual machine, or a Value belonging to one, after
+// it's been closed or reset.
+var ErrClosed = errors.New("virtual machine has been closed or reset")
+
+// Reset discards all of the virtual machine's Wren state, such as the variables and
+// classes defined by previous scripts and the modules they imported, so that the next
+// script starts afresh. Wren has no way to clear a module, so this replaces the
+// underlying Wren virtual machine with a new one.
+//
+// Everything configured from Go is kept, including registered foreign methods and
+// classes, output and error settings, and data set with SetData. Values and call handles
+// obtained before the reset refer to the old virtual machine and return ErrClosed if
+// used afterwards.
+func (vm *VM) Reset() error {
+	if vm.vm == nil {
+		return ErrClosed
+	}
+	if vm.running {
+		return ErrReentrant
+	}
+
+	old, oldData := vm.vm, vm.cdata
+	vm.cdata = newCData()
+	vm.cdata.json, oldData.json = oldData.json, nil
+	vm.vm = newCVM(vm.cdata)
+	vmMapGuard.Lock()
+	delete(vmMap, old)
+	vmMap[vm.vm] = vm
+	vmMapGuard.Unlock()
+	vm.releaseHandles(old)
+	C.wrenFreeVM(old)
+	C.free(unsafe.Pointer(oldData))
+
+	vm.refs = make(map[unsafe.Pointer]interface{})
+	vm.loaded = make(map[string]bool)
+	vm.importers = make(map[string]string)
+	vm.classModules = make(map[string]string)
+	vm.preluded = make(map[string]bool)
+	vm.objectClass, vm.sameCall = nil, nil
+	vm.sources = nil
+	vm.freeRetired()
+	vm.bound = make(map[unsafe.Pointer]bool)
+	if vm.gcTracking {
+		vm.gcTracking, vm.gcSeen = false, 0
+		return vm.SetGCHook(vm.gcHook)
+	}
+	return nil
+}
+
 // SetModulesDir sets lookup directory for modules to import from.
 func (vm *VM) SetModulesDir(path string) {
 	vm.setUserData("MODULES_DIR", path)
 }
 
+// SetModuleFS sets a filesystem to import modules from, such as an embed.FS. Modules
+// are looked up in it the same way as in the modules directory, and it takes
+// precedence over the modules directory if both are set.
+func (vm *VM) SetModuleFS(fsys fs.FS) {
+	vm.moduleFS = fsys
+}
+
 // setUserData preserves (key, val) userdata and makes it available to virtual machine.
 func (vm *VM) setUserData(key string, val interface{}) {
 	vm.userData[key] = val
 	if jval, e := json.Marshal(vm.userData); e == nil {
-		if vm.userDataPtr != nil {
-			C.free(vm.userDataPtr)
+		if vm.cdata.json != nil {
+			C.free(unsafe.Pointer(vm.cdata.json))
 		}
-		vm.userDataPtr = unsafe.Pointer(C.CString(string(jval)))
-		C.wrenSetUserData(vm.vm, vm.userDataPtr)
+		vm.cdata.json = C.CString(string(jval))
 	}
 }
 
+// SetData associates an arbitrary Go value with the virtual machine under the given
+// key, making host context such as database connections available to foreign methods
+// without resorting to globals. Setting a key to nil removes it.
+func (vm *VM) SetData(key string, v interface{}) {
+	if v == nil {
+		delete(vm.data, key)
+		return
+	}
+	vm.data[key] = v
+}
+
+// GetData returns the value stored under the given key by SetData, or nil if there
+// isn't one.
+func (vm *VM) GetData(key string) interface{} {
+	return vm.data[key]
+}
+
 // RegisterForeignMethod registers a foreign method with the virtual machine.
 //
 // fullName should be a fully-qualified description string for the method. In particular,
@@ -122,175 +604,2937 @@ func (vm *VM) setUserData(key string, val interface{}) {
 //
 // At minimum, it should have the class name and the method name separated by a period,
 // optionally with the word "static" out front to denote that it's a static method.
+// The method part is a standard Wren signature, so operators and subscripts are
+// registered the same way as any other method, e.g. "Vec.+(_)", "Vec.-", "Grid.[_,_]"
+// or "Grid.[_,_]=(_)".
+//
+// Registrations aren't tied to a module: the class may be declared in the main module,
+// in one run with InterpretNamed, or in one imported from the modules directory, and
+// classes of the same name in different modules share the same foreign methods.
+//
+// Wren doesn't let foreign methods list the keys of a map, so a method with a parameter
+// that may be given one as a Go map or an interface{}, directly or inside a slice or
+// struct, is declared as a Wren method in its place, which passes the keys along with
+// the arguments. The same goes for a Range or []int parameter, which is given the bounds
+// of a range passed to it. Such a method must be registered before its class is
+// declared, and calls whichever function is registered under its name at the time; the
+// foreign declaration must be on a line of its own.
+//
+// f must be a function. Its parameters are the receiver (for methods on foreign classes)
+// followed by the method's arguments, optionally preceded by a *VM parameter that will
+// be given the virtual machine making the call.
+//
+// If f panics, or its parameters don't match the arguments it's called with, the
+// current fiber is aborted with the panic's message as its error, which the script can
+// catch with Fiber.try like any other runtime error. If f's last result is an error,
+// a non-nil error fails the call the same way, and otherwise it's dropped, so a
+// function like func() error suits methods that are only run for their side effects.
+// Of the remaining results, a single result is returned to Wren as-is, several are
+// returned together as a list, and none at all returns null. A pair of results whose
+// second is a bool, as in func(key string) (string, bool), is also returned as a list,
+// unless the virtual machine has OptionalResults enabled.
 func (vm *VM) RegisterForeignMethod(fullName string, f interface{}) error {
-	ptr, err := registerFunc(fullName, func() {
-		if err := handleFunction(vm.vm, f); err != nil {
-			panic(err)
-		}
-	})
+	return vm.RegisterForeignMethodAliases(f, fullName)
+}
+
+// RegisterForeignMethodAliases registers f as a foreign method under each of the given
+// full names, which are written the same way as for RegisterForeignMethod. However many
+// names there are, they share a single slot in the foreign function registration pool,
+// where registering f under each name separately would take one slot per name. Since
+// Wren doesn't tell the shared function which name it was called by, hooks set by
+// SetCallHooks are always given the first name. Registering a name that's already
+// registered replaces its method for classes declared from then on. Classes that were
+// already declared keep the old binding, and calling the method through them aborts the
+// calling fiber, as after UnregisterForeignMethod; the old slot is freed once no other
+// name uses it, or if Wren has bound it, once Close or Reset gets rid of those classes.
+func (vm *VM) RegisterForeignMethodAliases(f interface{}, names ...string) error {
+	if len(names) == 0 {
+		return errors.New("no names given for foreign method")
+	}
+	ptr, err := vm.registerMethod(names[0], f)
 	if err != nil {
 		return err
 	}
-	vmMap[vm.vm].methods[fullName] = ptr
+	for _, name := range names {
+		vm.setMethod(name, ptr, f)
+	}
 	return nil
 }
 
-// RegisterForeignClass registers a foreign class with the virtual machine.
-func (vm *VM) RegisterForeignClass(className string, f func() interface{}) error {
-	ptr, err := registerFunc(className, func() {
-		newForeign(vm.vm, f())
+// registerMethod registers f as a foreign method in the registration pool, without
+// binding it to any names yet.
+func (vm *VM) registerMethod(fullName string, f interface{}) (unsafe.Pointer, error) {
+	return vm.register(fullName, func() {
+		defer abortOnPanic(vm.vm)
+		if err := vm.callForeign(fullName, f, int(C.wrenGetSlotCount(vm.vm))-1, noShape); err != nil {
+			// Panicking here would unwind through Wren's C stack, so fail the
+			// fiber instead, which scripts can catch with Fiber.try.
+			abortFiber(vm.vm, err.Error())
+		}
 	})
-	if err != nil {
-		return err
+}
+
+// setMethod binds the foreign method ptr, which calls f, to the given full name, freeing
+// the slot of the method previously registered under that name, if any, unless one of
+// its aliases still uses it.
+func (vm *VM) setMethod(fullName string, ptr unsafe.Pointer, f interface{}) {
+	old, ok := vm.methods[fullName]
+	vm.methods[fullName] = ptr
+	if ok && old != ptr {
+		vm.releaseMethod(old)
 	}
-	vmMap[vm.vm].classes[className] = ptr
-	return nil
+	skip := 0
+	if ft := reflect.TypeOf(f); ft != nil && ft.Kind() == reflect.Func {
+		if ft.NumIn() > 0 && ft.In(0) == vmType {
+			skip++
+		}
+		if dot := strings.Index(fullName, "."); ft.NumIn()-skip > signatureArity(fullName[dot+1:]) {
+			skip++ // the receiver, which is never a map
+		}
+	}
+	vm.setShaped(fullName, f, skip)
 }
 
-// SetOutputWriter sets the writer to be used for script output. If this method is never
-// called (or called with nil), it uses standard output.
-func (vm *VM) SetOutputWriter(w io.Writer) {
-	vmMap[vm.vm].outWriter = w
+// setShaped records whether the foreign method or constructor f registered under the
+// given name needs the shapes of its arguments, as for wrapForeign, judging by its
+// parameters after the first skip.
+func (vm *VM) setShaped(name string, f interface{}, skip int) {
+	ft := reflect.TypeOf(f)
+	seen := make(map[reflect.Type]bool)
+	for i := skip; ft != nil && ft.Kind() == reflect.Func && i < ft.NumIn(); i++ {
+		if needsShape(ft.In(i), seen) {
+			vm.shaped[name] = f
+			return
+		}
+	}
+	delete(vm.shaped, name)
 }
 
-// SetErrorWriter sets the writer to be used for script error output. If this method is never
-// called (or called with nil), it uses standard error.
-func SetErrorWriter(w io.Writer) {
-	errWriter = w
+// needsShape reports whether converting a Wren value to t may need its shape, namely the
+// keys of any maps in it, which foreign methods can't ask Wren for.
+func needsShape(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == rangeType || t == intsType {
+		return true
+	}
+	if t == valueType || seen[t] {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Map, reflect.Interface:
+		return true
+	case reflect.Slice, reflect.Array, reflect.Ptr:
+		return needsShape(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if needsShape(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// GC initiates a garbage collection.
-func (vm *VM) GC() {
-	C.wrenCollectGarbage(vm.vm)
+// releaseMethod frees the slot of the foreign method ptr unless it's still registered
+// under some name.
+func (vm *VM) releaseMethod(ptr unsafe.Pointer) {
+	for _, other := range vm.methods {
+		if other == ptr {
+			return
+		}
+	}
+	vm.release(ptr)
 }
 
-// Interpret interprets the provided Wren source code.
-func (vm *VM) Interpret(source string) error {
-	c_module := C.CString("main")
-	defer C.free(unsafe.Pointer(c_module))
-	c_source := C.CString(source)
-	defer C.free(unsafe.Pointer(c_source))
-	return interpretResultToErr(C.wrenInterpret(vm.vm, c_module, c_source))
+// register adds f to the foreign function registration pool under the given name.
+// Once its slot has been retired by release, calling it aborts the calling fiber
+// instead of running f.
+func (vm *VM) register(name string, f func()) (unsafe.Pointer, error) {
+	var ptr unsafe.Pointer
+	ptr, err := registerFunc(name, func() {
+		if vm.retired[ptr] {
+			abortFiber(vm.vm, fmt.Sprintf("%s is no longer registered", name))
+			return
+		}
+		f()
+	})
+	return ptr, err
 }
 
-// InterpretFile interprets the Wren source code in the provided file.
-func (vm *VM) InterpretFile(filename string) error {
-	contents, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+// release frees the slot of a foreign method or class that's no longer registered.
+// If Wren has already bound it to a class, the class keeps calling it, so the slot is
+// only retired, and isn't freed until Close or Reset gets rid of the class; freeing it
+// any sooner would let another registration take it over and be called in its place.
+func (vm *VM) release(ptr unsafe.Pointer) {
+	if vm.bound[ptr] {
+		vm.retired[ptr] = true
+		return
 	}
-	return vm.Interpret(string(contents))
+	unregisterFunc(ptr)
 }
 
-// InterpretReader interprets the Wren source code from the provided reader.
-// Note that the reader must be read fully before interpretation will begin;
-// it's not possible to interpret an infinite stream of input.
-func (vm *VM) InterpretReader(r io.Reader) error {
-	contents, err := ioutil.ReadAll(r)
-	if err != nil {
-		return err
+// freeRetired frees the slots retired by release, once the C virtual machine that
+// bound them is gone.
+func (vm *VM) freeRetired() {
+	for ptr := range vm.retired {
+		unregisterFunc(ptr)
+		delete(vm.retired, ptr)
 	}
-	return vm.Interpret(string(contents))
 }
 
-// TODO: implement this better. It should automatically pick an available
-// slot, then convert the value to something useful.
-func (vm *VM) getVariable(module, name string, slot int) {
-	var (
-		c_module = C.CString(module)
-		c_name   = C.CString(name)
-	)
-	defer func() {
-		C.free(unsafe.Pointer(c_module))
-		C.free(unsafe.Pointer(c_name))
-	}()
-	C.wrenGetVariable(vm.vm, c_module, c_name, C.int(slot))
+// setClass binds the foreign class ptr to the given class name, freeing the slot of
+// the class previously registered under that name, if any.
+func (vm *VM) setClass(className string, ptr unsafe.Pointer) {
+	if old, ok := vm.classes[className]; ok && old != ptr {
+		vm.release(old)
+	}
+	vm.classes[className] = ptr
+	delete(vm.shaped, className)
 }
 
-// Value represents a Wren value that Go has a handle to.
-type Value struct {
-	vm      *C.WrenVM
-	value   *C.WrenHandle
-	methods map[string]*C.WrenHandle
+// callForeign calls a foreign method, running any hooks set by SetCallHooks around it.
+// given and shapes are passed on to handleFunction.
+func (vm *VM) callForeign(fullName string, f interface{}, given, shapes int) error {
+	if vm.outputExceeded {
+		return ErrOutputLimit
+	}
+	if vm.callbackErr != nil {
+		return vm.callbackErr
+	}
+	if vm.beforeCall != nil {
+		vm.beforeCall(fullName)
+	}
+	defer vm.armGCSentinel()
+	if vm.afterCall == nil {
+		return handleFunction(vm.vm, f, given, shapes)
+	}
+	start := time.Now()
+	err := handleFunction(vm.vm, f, given, shapes)
+	vm.afterCall(fullName, time.Since(start), err)
+	return err
 }
 
-// Variable looks up a variable by name and returns its value.
-func (vm *VM) Variable(name string) *Value {
-	var (
-		c_module = C.CString("main")
-		c_name   = C.CString(name)
-	)
-	defer func() {
-		C.free(unsafe.Pointer(c_module))
-		C.free(unsafe.Pointer(c_name))
-	}()
+// SetCallHooks sets functions to be called before and after every call Wren makes to
+// a foreign method, for tracing or profiling. Both are given the method's full name as
+// it was registered, and after is also given how long the call took and the error it
+// failed with, if any. Either may be nil.
+func (vm *VM) SetCallHooks(before func(method string), after func(method string, elapsed time.Duration, err error)) {
+	vm.beforeCall, vm.afterCall = before, after
+}
 
-	C.wrenEnsureSlots(vm.vm, 1)
-	C.wrenGetVariable(vm.vm, c_module, c_name, 0)
-	value := Value{vm: vm.vm, value: C.wrenGetSlotHandle(vm.vm, 0)}
-	if value.value == nil {
-		return nil
-	}
-	value.methods = make(map[string]*C.WrenHandle)
-	runtime.SetFinalizer(&value, func(value *Value) {
-		for _, method := range value.methods {
-			C.wrenReleaseHandle(vm.vm, method)
-		}
-		C.wrenReleaseHandle(vm.vm, value.value)
-	})
-	return &value
+// InCall reports whether the virtual machine is currently running Wren code, as it is
+// for the duration of an Interpret or Call, including from within foreign methods.
+func (vm *VM) InCall() bool {
+	return vm.running
 }
 
-// Call calls the method with the given signature that belongs to the given value.
+// RegisterForeignStruct registers each exported method of v as a static foreign method
+// on the Wren class className, with v acting as the shared receiver. The Wren method name
+// is the Go method name with its first letter lowercased, and its arity is the number of
+// parameters the Go method takes (not counting a leading *VM), so a method
 //
-// The receiver should be the value on which the method is defined; a class reference
-// for static methods, and an instance of a class for instance methods. The signature
-// is a standard Wren method signature, and any parameters it expects will follow.
-func (v *Value) Call(signature string, params ...interface{}) (interface{}, error) {
-	f := v.methods[signature]
-	if f == nil {
-		c_signature := C.CString(signature)
-		defer C.free(unsafe.Pointer(c_signature))
-		f = C.wrenMakeCallHandle(v.vm, c_signature)
-		v.methods[signature] = f
+//     func (api *API) Greet(name string) string
+//
+// is registered as "static <className>.greet(_)". Methods without parameters are
+// registered as "name()" rather than as getters. Each method takes up one slot in
+// the foreign function registration pool.
+func (vm *VM) RegisterForeignStruct(className string, v interface{}) error {
+	var (
+		rv = reflect.ValueOf(v)
+		rt = rv.Type()
+	)
+	for i := 0; i < rt.NumMethod(); i++ {
+		var (
+			method = rv.Method(i)
+			mt     = method.Type()
+			arity  = mt.NumIn()
+		)
+		if arity > 0 && mt.In(0) == vmType {
+			arity--
+		}
+		name := rt.Method(i).Name
+		fullName := fmt.Sprintf("static %s.%s%s(%s)", className, strings.ToLower(name[:1]), name[1:],
+			strings.TrimSuffix(strings.Repeat("_,", arity), ","))
+		if err := vm.RegisterForeignMethod(fullName, method.Interface()); err != nil {
+			return fmt.Errorf("registering %s: %w", fullName, err)
+		}
 	}
-	C.wrenEnsureSlots(v.vm, C.int(len(params)+1))
-	C.wrenSetSlotHandle(v.vm, 0, v.value)
-	for i, param := range params {
-		saveToSlot(v.vm, i+1, reflect.ValueOf(param))
+	return nil
+}
+
+// RegisterAll registers each of the given foreign methods, keyed by their full names
+// as for RegisterForeignMethod, in alphabetical order. Each function is checked the
+// same way as by RegisterMethod. If any of them can't be registered, such as because
+// the limit on registrations has been reached, the error names the offending method,
+// and the virtual machine is left as it was, including any methods that were already
+// registered under the same names.
+func (vm *VM) RegisterAll(methods map[string]interface{}) error {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
 	}
-	if err := interpretResultToErr(C.wrenCall(v.vm, f)); err != nil {
-		return nil, err
+	sort.Strings(names)
+
+	ptrs := make([]unsafe.Pointer, 0, len(names))
+	for _, name := range names {
+		err := checkMethodType(name, reflect.TypeOf(methods[name]))
+		if err == nil {
+			var ptr unsafe.Pointer
+			if ptr, err = vm.registerMethod(name, methods[name]); err == nil {
+				ptrs = append(ptrs, ptr)
+			}
+		}
+		if err != nil {
+			for _, ptr := range ptrs {
+				unregisterFunc(ptr)
+			}
+			return fmt.Errorf("registering %s: %w", name, err)
+		}
 	}
-	if retval := getFromSlot(v.vm, 0, nil); retval.IsValid() {
-		return retval.Interface(), nil
+	// Nothing is bound to its name until everything has been registered, so that
+	// a failure doesn't disturb methods registered earlier.
+	for i, name := range names {
+		vm.setMethod(name, ptrs[i], methods[name])
 	}
-	return nil, nil
+	return nil
 }
 
-// newForeign allocates a new foreign object.
+// RegisterForeignClass registers a foreign class with the virtual machine.
 //
-// This method should only be called from a foreign class allocation function.
-// It takes an instance of the VM and a newly allocated foreign object ("foreign"
-// meaning that it's created in Go and not Wren) and makes it available to Wren.
-func newForeign(vm *C.WrenVM, x interface{}) {
-	var (
-		v   = reflect.Indirect(reflect.ValueOf(x))
-		t   = v.Type()
-		ptr = C.wrenSetSlotNewForeign(vm, C.int(0), C.int(0), C.size_t(t.Size()))
-	)
-	reflect.NewAt(t, ptr).Elem().Set(v)
+// f is called once during registration to learn the type of value it returns. After
+// that, foreign methods returning a value of that type give Wren a new instance of
+// the class holding it, rather than trying to convert the value itself.
+//
+// If any onAlloc functions are given, they're called each time a script constructs
+// an instance of the class, after it's been created, with the value returned by f.
+// This allows keeping track of foreign objects, such as to count how many have been
+// made or to check for leaks in tests. They aren't called for instances returned from
+// foreign methods, which aren't constructed.
+func (vm *VM) RegisterForeignClass(className string, f func() interface{}, onAlloc ...func(interface{})) error {
+	ptr, err := vm.register(className, func() {
+		defer abortOnPanic(vm.vm)
+		x := f()
+		newForeign(vm.vm, 0, 0, x)
+		for _, fn := range onAlloc {
+			fn(x)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	vm.setClass(className, ptr)
+	vm.recordForeignType(className, f)
+	return nil
 }
 
-// handleFunction is a helper method for foreign methods.
+// RegisterForeignClassArgs registers a foreign class like RegisterForeignClass, but
+// whose values are made from the arguments passed to its constructor. f must be a
+// function returning the new value, and its parameters are filled in from the
+// constructor's arguments the same way as a foreign method's, so func(x, y float64) Vec
+// suits a class constructed with Vec.new(1, 2).
 //
-// This method takes two parameters: a reference to the virtual machine instance
-// (which should be the only parameter provided in the C-exported callback)
-// and a Go function. The function's signature must match the one expected by Wren.
-// If it doesn't, this call will return an error, but the call to Interpret() will not.
+// Calling a constructor with a different number of arguments than f takes aborts the
+// calling fiber, unless f is variadic; func(args ...interface{}) interface{} accepts
+// any arguments at all. So does a panic in f.
 //
-// For examples, check out the test package.
-func handleFunction(vm *C.WrenVM, f interface{}) (err error) {
+// If f takes maps, the constructors of the class are declared as static Wren methods in
+// its place, the same way as foreign methods taking them are; see RegisterForeignMethod.
+func (vm *VM) RegisterForeignClassArgs(className string, f interface{}) error {
+	ft := reflect.TypeOf(f)
+	if ft == nil || ft.Kind() != reflect.Func || ft.NumOut() != 1 {
+		return fmt.Errorf("%s: expected a function returning a single value, got %v", className, ft)
+	}
+	ptr, err := vm.register(className, func() {
+		defer abortOnPanic(vm.vm)
+		if err := construct(vm.vm, f, int(C.wrenGetSlotCount(vm.vm))-1, noShape); err != nil {
+			abortFiber(vm.vm, err.Error())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	vm.setClass(className, ptr)
+	vm.setShaped(className, f, 0)
+	if out := ft.Out(0); out.Kind() != reflect.Interface {
+		vm.foreignTypes[out] = className
+	}
+	return nil
+}
+
+// construct calls a constructor function registered with RegisterForeignClassArgs
+// with the given number of arguments in slot 1 onwards, and saves the value it returns
+// as the new foreign object in slot 0. shapes is as for handleFunction.
+func construct(vm *C.WrenVM, f interface{}, given, shapes int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = withStack(vm, fmt.Errorf("%v", r))
+		}
+	}()
+
+	var (
+		fv     = reflect.ValueOf(f)
+		ft     = fv.Type()
+		fixed  = ft.NumIn()
+		params = make([]reflect.Value, given)
+	)
+	if ft.IsVariadic() {
+		fixed--
+	}
+	if len(params) < fixed || len(params) > fixed && !ft.IsVariadic() {
+		return fmt.Errorf("constructor takes %d arguments, but was given %d", fixed, len(params))
+	}
+	for i := range params {
+		var t reflect.Type
+		if i < fixed {
+			t = ft.In(i)
+		} else {
+			t = ft.In(fixed).Elem()
+		}
+		var hint *reflect.Type
+		if t.Kind() != reflect.Interface {
+			hint = &t
+		}
+		if params[i] = getFromSlot(vm, i+1, argShape(shapes, i), hint); !params[i].IsValid() {
+			params[i] = reflect.Zero(t)
+		}
+	}
+	newForeign(vm, 0, 0, fv.Call(params)[0].Interface())
+	return nil
+}
+
+// recordForeignType remembers the type of value returned by f as belonging to the
+// given foreign class.
+func (vm *VM) recordForeignType(className string, f func() interface{}) {
+	if x := f(); x != nil {
+		vm.foreignTypes[reflect.TypeOf(x)] = className
+	}
+}
+
+// RegisterForeignClassRef registers a foreign class whose instances refer to the
+// Go values returned by f, rather than holding copies of them the way instances of
+// classes registered with RegisterForeignClass do. f must return a pointer, and
+// foreign methods receive that same pointer, so it's safe to use for types that
+// must not be copied, such as structs containing a sync.Mutex, and any changes
+// made through the pointer are visible to everything else holding it.
+//
+// Wren's memory is invisible to the Go garbage collector, so the virtual machine
+// pins each value returned by f for as long as the Wren object referring to it is
+// alive. Once Wren collects the object (or the virtual machine itself is freed),
+// the value is unpinned and becomes eligible for Go garbage collection as usual.
+//
+// As with RegisterForeignClass, f is called once during registration so that foreign
+// methods returning pointers of the same type give Wren instances of the class.
+func (vm *VM) RegisterForeignClassRef(className string, f func() interface{}) error {
+	ptr, err := vm.register(className, func() {
+		defer abortOnPanic(vm.vm)
+		newForeignRef(vm.vm, 0, 0, f())
+	})
+	if err != nil {
+		return err
+	}
+	vm.setClass(className, ptr)
+	vm.refClasses[className] = true
+	vm.recordForeignType(className, f)
+	return nil
+}
+
+// RegisterGenerator registers a foreign class whose instances can be iterated over in
+// a for loop, producing the values received from the channel returned by gen. gen is
+// called each time the class is constructed, so the class must be declared in Wren
+// with a constructor taking no arguments and the two methods of the iterator protocol:
+//
+//     foreign class QueryResult {
+//         construct new() {}
+//         foreign iterate(iterator)
+//         foreign iteratorValue(iterator)
+//     }
+//
+// Scripts can then write for (row in QueryResult.new()) { ... }. Each step of the loop
+// blocks until a value is received, and the loop ends when the channel is closed, so
+// gen must not return a nil channel. Values are converted the same way as the results
+// of foreign methods. If gen returns an error, constructing the class aborts the calling
+// fiber with it. The class and its two methods take up three slots in the foreign
+// function registration pool.
+func (vm *VM) RegisterGenerator(className string, gen func() (<-chan interface{}, error)) error {
+	ptr, err := vm.register(className, func() {
+		defer abortOnPanic(vm.vm)
+		ch, err := gen()
+		if err != nil {
+			abortFiber(vm.vm, err.Error())
+			return
+		}
+		newForeignRef(vm.vm, 0, 0, &generator{ch: ch})
+	})
+	if err != nil {
+		return err
+	}
+	vm.setClass(className, ptr)
+	vm.refClasses[className] = true
+
+	if err := vm.RegisterAll(map[string]interface{}{
+		className + ".iterate(_)":       (*generator).iterate,
+		className + ".iteratorValue(_)": (*generator).iteratorValue,
+	}); err != nil {
+		vm.UnregisterForeignClass(className)
+		return err
+	}
+	return nil
+}
+
+// generator is the value held by instances of classes registered with RegisterGenerator.
+type generator struct {
+	ch      <-chan interface{}
+	current interface{}
+	count   int
+}
+
+// iterate receives the next value from the channel, returning false once it's closed
+// and otherwise the number of values received so far, as Wren's iterator protocol
+// expects.
+func (g *generator) iterate(iterator interface{}) interface{} {
+	x, ok := <-g.ch
+	if !ok {
+		g.current = nil
+		return false
+	}
+	g.current = x
+	g.count++
+	return g.count
+}
+
+// iteratorValue returns the value most recently received by iterate.
+func (g *generator) iteratorValue(iterator interface{}) interface{} {
+	return g.current
+}
+
+// RegisterConstants defines a Wren class in the main module with a static getter for
+// each of the given constants, such as the values of a Go enum, so that
+//
+//     vm.RegisterConstants("Color", map[string]int{"Red": 0, "Green": 1})
+//
+// lets scripts refer to Color.Red and Color.Green without declaring them. The class
+// also gets a static method name(_) for the reverse lookup, so Color.name(1) returns
+// "Green", and null for values that aren't one of the constants; if several constants
+// share a value, the alphabetically first name is returned. The class is plain Wren
+// rather than foreign, so it doesn't take up any slots in the registration pool.
+//
+// Wren classes can't be added to once they're defined, so each class must have all of
+// its constants registered in a single call; registering constants for a class that
+// already exists fails.
+func (vm *VM) RegisterConstants(className string, constants map[string]int) error {
+	if !isIdentifier(className) {
+		return fmt.Errorf("%q isn't a valid Wren class name", className)
+	}
+	c_className := C.CString(className)
+	defer C.free(unsafe.Pointer(c_className))
+	if C.wrenHasModule(vm.vm, vm.mainModule) && C.wrenHasVariable(vm.vm, vm.mainModule, c_className) {
+		return fmt.Errorf("%s is already defined; register all of its constants in one call", className)
+	}
+	names := make([]string, 0, len(constants))
+	for name := range constants {
+		if !isIdentifier(name) {
+			return fmt.Errorf("%s: %q isn't a valid Wren identifier", className, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		source strings.Builder
+		seen   = make(map[int]bool)
+	)
+	fmt.Fprintf(&source, "class %s {\n", className)
+	for _, name := range names {
+		fmt.Fprintf(&source, "  static %s { %d }\n", name, constants[name])
+	}
+	source.WriteString("  static name(value) {\n    if (__names == null) __names = {")
+	for _, name := range names {
+		if value := constants[name]; !seen[value] {
+			if len(seen) > 0 {
+				source.WriteString(", ")
+			}
+			fmt.Fprintf(&source, "%d: %q", value, name)
+			seen[value] = true
+		}
+	}
+	source.WriteString("}\n    return __names[value]\n  }\n}\n")
+	return vm.Interpret(source.String())
+}
+
+// reservedWords are Wren's keywords, which can't be used as names.
+var reservedWords = map[string]bool{
+	"as": true, "break": true, "class": true, "construct": true, "continue": true,
+	"else": true, "false": true, "for": true, "foreign": true, "if": true, "import": true,
+	"in": true, "is": true, "null": true, "return": true, "static": true, "super": true,
+	"this": true, "true": true, "var": true, "while": true,
+}
+
+// isIdentifier reports whether name can be used as the name of a Wren class or
+// method. Names starting with an underscore are fields rather than identifiers.
+func isIdentifier(name string) bool {
+	for i, r := range name {
+		if !(i > 0 && r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || i > 0 && '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return name != "" && !reservedWords[name]
+}
+
+// RegisterMethod registers a foreign method like vm.RegisterForeignMethod, but checks
+// f when it's registered rather than when Wren first calls it. f must be a function
+// (that isn't variadic), and its number of parameters must match the number of
+// arguments in fullName's signature, plus one for the receiver if it's a method on a
+// foreign class and not counting a leading *VM parameter.
+func RegisterMethod[F any](vm *VM, fullName string, f F) error {
+	if err := checkMethodType(fullName, reflect.TypeOf(f)); err != nil {
+		return err
+	}
+	return vm.RegisterForeignMethod(fullName, f)
+}
+
+// RegisterClass registers a foreign class like vm.RegisterForeignClass, but with
+// the type of its values known at compile time.
+func RegisterClass[T any](vm *VM, className string, f func() T) error {
+	return vm.RegisterForeignClass(className, func() interface{} {
+		return f()
+	})
+}
+
+// RegisterClassRef registers a foreign class like vm.RegisterForeignClassRef, but
+// with the type of its values known at compile time, which also guarantees that f
+// returns a pointer.
+func RegisterClassRef[T any](vm *VM, className string, f func() *T) error {
+	return vm.RegisterForeignClassRef(className, func() interface{} {
+		return f()
+	})
+}
+
+// checkMethodType checks that a function of type ft can be registered as the
+// foreign method fullName.
+func checkMethodType(fullName string, ft reflect.Type) error {
+	if ft == nil || ft.Kind() != reflect.Func {
+		return fmt.Errorf("%s: expected a function, got %v", fullName, ft)
+	}
+	if ft.IsVariadic() {
+		return fmt.Errorf("%s: variadic functions can't be foreign methods", fullName)
+	}
+	dot := strings.Index(fullName, ".")
+	if dot < 0 {
+		return fmt.Errorf("%s: expected a name of the form \"[static ]<class>.<method>\"", fullName)
+	}
+
+	arity := signatureArity(fullName[dot+1:])
+	params := ft.NumIn()
+	if params > 0 && ft.In(0) == vmType {
+		params--
+	}
+	if params == arity || params == arity+1 && !strings.HasPrefix(fullName, "static ") {
+		return nil
+	}
+	return fmt.Errorf("%s: signature has %d arguments, but the function has %d parameters", fullName, arity, params)
+}
+
+// UnregisterForeignMethod removes a foreign method previously registered with
+// RegisterForeignMethod and frees its slot in the registration pool, unless aliases
+// registered with RegisterForeignMethodAliases still share it. Classes declared after
+// this call will fail at bind time when they reference the method, just as if it had
+// never been registered. Classes that were already declared keep the old binding, and
+// calling the method through them aborts the calling fiber; since they still refer to
+// its slot, it stays taken until Close or Reset.
+func (vm *VM) UnregisterForeignMethod(fullName string) {
+	ptr, ok := vm.methods[fullName]
+	if !ok {
+		return
+	}
+	delete(vm.methods, fullName)
+	delete(vm.shaped, fullName)
+	vm.releaseMethod(ptr)
+}
+
+// UnregisterForeignClass removes a foreign class previously registered with
+// RegisterForeignClass and frees its slot in the registration pool. The same
+// caveats as UnregisterForeignMethod apply: constructing a class declared beforehand
+// aborts the calling fiber. So does constructing a foreign class declared without
+// being registered at all.
+func (vm *VM) UnregisterForeignClass(className string) {
+	if ptr, ok := vm.classes[className]; ok {
+		delete(vm.classes, className)
+		delete(vm.refClasses, className)
+		delete(vm.shaped, className)
+		for t, name := range vm.foreignTypes {
+			if name == className {
+				delete(vm.foreignTypes, t)
+			}
+		}
+		vm.release(ptr)
+	}
+}
+
+// RegisteredMethods returns the full names of all foreign methods registered with
+// the virtual machine, sorted alphabetically. The returned slice is a copy and may
+// be freely modified.
+func (vm *VM) RegisteredMethods() []string {
+	return sortedKeys(vm.methods)
+}
+
+// RegisteredClasses returns the names of all foreign classes registered with
+// the virtual machine, sorted alphabetically. The returned slice is a copy and may
+// be freely modified.
+func (vm *VM) RegisteredClasses() []string {
+	return sortedKeys(vm.classes)
+}
+
+func sortedKeys(m map[string]unsafe.Pointer) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SetClock sets the time source used by the built-in foreign getter "static Go.clock".
+// Wren doesn't allow adding methods to the core System class, so scripts that want
+// to use it need to declare it themselves:
+//
+//     class Go {
+//       foreign static clock
+//     }
+//
+// Providing a fixed or manually-advanced clock makes scripts that depend on elapsed
+// time deterministic under test. If fn is nil, Go.clock reports the current Unix time
+// in seconds.
+func (vm *VM) SetClock(fn func() float64) error {
+	if fn == nil {
+		fn = func() float64 {
+			return float64(time.Now().UnixNano()) / float64(time.Second)
+		}
+	}
+	if vm.clock == nil {
+		// Only remember fn once Go.clock is registered, so that a failed
+		// registration is retried by the next call.
+		err := vm.RegisterForeignMethod("static Go.clock", func() float64 {
+			return vm.clock()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	vm.clock = fn
+	return nil
+}
+
+// ExposeEnv makes the named environment variables readable by scripts through the
+// built-in foreign method "static Go.env(_)", which scripts declare the same way as
+// Go.clock:
+//
+//     class Go {
+//       foreign static env(name)
+//     }
+//
+// Go.env returns the variable's value, or null if it isn't set or isn't one of the
+// names exposed, so scripts can't read anything the host didn't intend to share, such
+// as credentials. Calling ExposeEnv again adds to the names already exposed.
+func (vm *VM) ExposeEnv(names ...string) error {
+	if vm.env == nil {
+		// Only create the set once Go.env is registered, so that a failed
+		// registration is retried by the next call.
+		err := vm.RegisterForeignMethod("static Go.env(_)", func(name string) *string {
+			if !vm.env[name] {
+				return nil
+			}
+			if value, ok := os.LookupEnv(name); ok {
+				return &value
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		vm.env = make(map[string]bool)
+	}
+	for _, name := range names {
+		vm.env[name] = true
+	}
+	return nil
+}
+
+// UseJSONTags controls how Go structs are converted to Wren maps. By default, each
+// exported field is keyed by its name; when enabled, fields are keyed by their json
+// tag names where present, and fields tagged "-" are left out, matching
+// encoding/json.
+func (vm *VM) UseJSONTags(use bool) {
+	vm.jsonTags = use
+}
+
+// UseStringers controls how Go values implementing fmt.Stringer are converted to Wren
+// values. By default, they're converted according to their underlying type, so an enum
+// declared as a named int becomes a number; when enabled, they're converted to the
+// strings returned by their String methods instead, which also applies to types such
+// as time.Duration. Values of registered foreign classes are unaffected.
+func (vm *VM) UseStringers(use bool) {
+	vm.useStringers = use
+}
+
+// DisallowUnknownFields controls how Wren maps are converted to Go structs, such as
+// for a foreign method taking a struct parameter. By default, keys without a matching
+// field are ignored; when disallowed, they fail the call instead, which catches typos
+// in option names.
+func (vm *VM) DisallowUnknownFields(disallow bool) {
+	vm.strictFields = disallow
+}
+
+// StrictArity controls what happens when Wren calls a foreign method with a different
+// number of arguments than its Go function takes, which means the function doesn't
+// match the signature it was registered under. By default, extra arguments are ignored;
+// when strict, the call fails instead, aborting the calling fiber.
+func (vm *VM) StrictArity(strict bool) {
+	vm.strictArity = strict
+}
+
+// ErrInvalidUTF8 is returned when source code that isn't valid UTF-8 is interpreted
+// by a virtual machine that validates it; see ValidateUTF8.
+var ErrInvalidUTF8 = errors.New("source is not valid UTF-8")
+
+// ValidateUTF8 controls whether source code is checked to be valid UTF-8 before it's
+// run. Wren assumes that it is, and doesn't check. When enabled, Interpret and its
+// variants return an error wrapping ErrInvalidUTF8, with the module and line of the
+// first invalid byte, instead of running invalid source. Imported modules aren't
+// checked, since there's no way to report the error to the importing script.
+func (vm *VM) ValidateUTF8(validate bool) {
+	vm.validateUTF8 = validate
+}
+
+// PreferIntegers controls how Wren numbers are converted when there's no particular
+// Go type to convert them to, such as the results of Call and the elements of lists
+// passed as []interface{}. By default they're always float64; when enabled, numbers
+// with no fractional part within the range where Wren represents integers exactly
+// are converted to int64 instead.
+func (vm *VM) PreferIntegers(prefer bool) {
+	vm.preferIntegers = prefer
+}
+
+// OptionalResults controls how foreign methods returning a pair of results whose second
+// is a bool, as in func(key string) (string, bool), are handled. By default the pair is
+// returned as a list like any other pair of results; when enabled, the bool reports
+// whether the first result is present, following Wren's use of null for absent values,
+// so the first result is returned if it's true and null if it's false. A trailing error
+// is set aside first, so func(key string) (string, bool, error) counts as a pair too.
+func (vm *VM) OptionalResults(optional bool) {
+	vm.optionalResults = optional
+}
+
+// SetOutputWriter sets the writer to be used for script output. If this method is never
+// called (or called with nil), it uses standard output.
+//
+// Output written to standard output is written a line at a time, with writes from all
+// virtual machines serialized, so that scripts running concurrently in different
+// virtual machines can't garble each other's lines. Any other writer is written to
+// directly, so if it's shared between virtual machines running concurrently, it's up
+// to the writer to synchronize itself.
+//
+// Setting the output writer also removes any writers added with AddOutputWriter.
+func (vm *VM) SetOutputWriter(w io.Writer) {
+	vm.outWriter = w
+	vm.teeWriters = nil
+}
+
+// AddOutputWriter adds a writer that receives a copy of all script output, on top of
+// the output writer, such as a buffer to capture output while still printing it to
+// standard output.
+func (vm *VM) AddOutputWriter(w io.Writer) {
+	vm.teeWriters = append(vm.teeWriters, w)
+}
+
+// Flush writes out any partial line of output held back from standard output, then
+// flushes the output writer and any writers added with AddOutputWriter that have a
+// Flush() error method, such as a *bufio.Writer, returning the first error. It's
+// called whenever an Interpret or Call finishes, whether or not it succeeded, so it's
+// only needed to see output while a script is still running, such as from a foreign
+// method.
+func (vm *VM) Flush() error {
+	vm.flushStdout()
+	var first error
+	for _, w := range append([]io.Writer{vm.outWriter}, vm.teeWriters...) {
+		if f, ok := w.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// ErrOutputLimit is returned when a script exceeds the limit set by SetOutputLimit.
+var ErrOutputLimit = errors.New("script exceeded its output limit")
+
+// SetOutputLimit limits how many bytes of output each call to Interpret or Call may
+// produce, to protect against scripts printing endlessly. A limit of zero or less
+// removes the limit.
+//
+// Once the limit is reached, any further output is discarded and the Interpret or Call
+// returns ErrOutputLimit. Output is cut short at the last whole UTF-8 character that
+// fits, and lowering the limit while a script is running, such as from a foreign
+// method, below what it's already printed discards everything from then on. Wren
+// provides no way to stop a script from inside of System.print, so the script itself
+// is only stopped the next time it calls a foreign method, including the built-in
+// Go.tick() described by InterpretContext; scripts that never call one run to
+// completion, silently. There is no corresponding limit on the
+// number of instructions executed, since Wren offers no hook to count them; use
+// InterpretContext or InterpretTimeout instead.
+func (vm *VM) SetOutputLimit(bytes int64) {
+	vm.outputLimit = bytes
+}
+
+// SetOutputFunc sets a function to be called with each piece of script output, such as
+// each call to System.print or System.write. When set, it takes precedence over the
+// output writer; call it with nil to go back to using the writer.
+//
+// If fn, or an output writer, panics, the rest of the script's output is dropped, its
+// next call to a foreign method fails, and the Interpret or Call returns an error
+// describing the panic.
+func (vm *VM) SetOutputFunc(fn func(s string)) {
+	vm.outFunc = fn
+}
+
+// The types of error reported to an error function set with SetErrorFunc.
+const (
+	ErrorTypeCompile    = "compile"
+	ErrorTypeRuntime    = "runtime"
+	ErrorTypeStackTrace = "stack trace"
+)
+
+// SetErrorFunc sets a function to be called with each error reported by the virtual
+// machine, instead of writing them to the error writer. errType is one of
+// ErrorTypeCompile, ErrorTypeRuntime or ErrorTypeStackTrace. A runtime error is
+// followed by one stack trace report per frame, innermost first; runtime errors
+// themselves have no module or line. Call it with nil to go back to using the
+// error writer. A panic in fn is handled the same way as one in an output function
+// set with SetOutputFunc.
+func (vm *VM) SetErrorFunc(fn func(errType, module string, line int, msg string)) {
+	vm.errFunc = fn
+}
+
+// SetErrorWriter sets the writer to be used for script error output. If this method is never
+// called (or called with nil), it uses standard error.
+func SetErrorWriter(w io.Writer) {
+	errWriter = w
+}
+
+// SetDebug enables or disables debug mode. In debug mode, failures to bind a foreign
+// method are reported to the error writer along with the names of all registered
+// methods, which makes signature mismatches much easier to spot, and when a foreign
+// method or constructor panics, the Go stack trace is added to the error message that
+// the calling fiber is aborted with. Otherwise, scripts only see the panic's message.
+func (vm *VM) SetDebug(debug bool) {
+	vm.debug = debug
+}
+
+// GC initiates a garbage collection.
+func (vm *VM) GC() {
+	C.wrenCollectGarbage(vm.vm)
+	vm.observeGC()
+}
+
+// Interpret interprets the provided Wren source code.
+func (vm *VM) Interpret(source string) error {
+	c_source := C.CString(source)
+	defer C.free(unsafe.Pointer(c_source))
+	return vm.interpret(vm.mainModule, c_source)
+}
+
+// interpret runs the source as the given module, guarding against re-entrant use.
+func (vm *VM) interpret(c_module, c_source *C.char) error {
+	return vm.interpretRewritten(c_module, c_source, nil)
+}
+
+// interpretRewritten is interpret, but with a function that rewrites the source just
+// before it's compiled, after any source transform. rewrite returns the new source
+// along with the line before which it inserted lines and how many, if it did, so that
+// errors can still be reported against the lines of the source it was given.
+func (vm *VM) interpretRewritten(c_module, c_source *C.char, rewrite func(source string) (string, int, int)) error {
+	module := C.GoString(c_module)
+	if len(vm.shaped) > 0 && vm.vm != nil && !vm.running && !isInternalModule(module) {
+		if err := vm.installForeign(); err != nil {
+			return err
+		}
+	}
+	if err := vm.enter(); err != nil {
+		return err
+	}
+	defer vm.exit()
+
+	if vm.sourceTransform != nil {
+		c_source = C.CString(vm.transformSource(module, C.GoString(c_source)))
+		defer C.free(unsafe.Pointer(c_source))
+	}
+
+	if vm.validateUTF8 {
+		name := module
+		if name == "main" && vm.displayName != "" {
+			name = vm.displayName
+		}
+		if err := checkUTF8(name, C.GoString(c_source)); err != nil {
+			return err
+		}
+	}
+
+	// Hold on to the source while it runs, so that compile errors can quote it.
+	vm.source, vm.sourceModule = c_source, module
+	if vm.keepSources {
+		vm.keepSource(module, C.GoString(c_source))
+	}
+	defer func() {
+		vm.source, vm.sourceModule = nil, ""
+	}()
+	if rewrite != nil {
+		var source string
+		source, vm.insertedAt, vm.inserted = rewrite(C.GoString(c_source))
+		defer func() {
+			vm.insertedAt, vm.inserted = 0, 0
+		}()
+		c_source = C.CString(source)
+		defer C.free(unsafe.Pointer(c_source))
+	}
+	if vm.loaded[foreignModule] && !isInternalModule(module) {
+		if source, ok := vm.wrapForeign(C.GoString(c_source)); ok {
+			if err := vm.importForeign(c_module); err != nil {
+				return err
+			}
+			c_source = C.CString(source)
+			defer C.free(unsafe.Pointer(c_source))
+		}
+	}
+	return vm.resultToErr(C.wrenInterpret(vm.vm, c_module, c_source))
+}
+
+// interpretGenerated runs source generated by this package as the given module. Unlike
+// interpret, it bypasses the source transform and kept sources, which are for the
+// scripts being run rather than for the code used to drive them.
+func (vm *VM) interpretGenerated(c_module *C.char, source string) error {
+	if err := vm.enter(); err != nil {
+		return err
+	}
+	defer vm.exit()
+
+	c_source := C.CString(source)
+	defer C.free(unsafe.Pointer(c_source))
+	return vm.resultToErr(C.wrenInterpret(vm.vm, c_module, c_source))
+}
+
+// checkUTF8 returns an error wrapping ErrInvalidUTF8 if source isn't valid UTF-8.
+func checkUTF8(module, source string) error {
+	for i, line := range strings.Split(source, "\n") {
+		if !utf8.ValidString(line) {
+			return fmt.Errorf("%w: %s:%d", ErrInvalidUTF8, module, i+1)
+		}
+	}
+	return nil
+}
+
+// SetSourceTransform sets a function that sees the source of every module before Wren
+// compiles it, and returns the source to compile in its place. It's given the name of
+// the module, which is "main" for code run with Interpret and the like, and applies to
+// imported modules too. This allows for preprocessing such as injecting a common
+// prelude into every module. Passing nil removes the transform.
+func (vm *VM) SetSourceTransform(fn func(module, source string) string) {
+	vm.sourceTransform = fn
+}
+
+// transformSource applies the source transform, if there is one, to the source of
+// the given module. The package's own modules are left alone.
+func (vm *VM) transformSource(module, source string) string {
+	if vm == nil || vm.sourceTransform == nil || isInternalModule(module) {
+		return source
+	}
+	return vm.sourceTransform(module, source)
+}
+
+// resultToErr converts the result of running Wren code into an error, taking into
+// account any limits the code ran into.
+func (vm *VM) resultToErr(result C.WrenInterpretResult) error {
+	switch result {
+	case C.WREN_RESULT_SUCCESS:
+		vm.lastErrorKind = ErrorKindNone
+	case C.WREN_RESULT_COMPILE_ERROR:
+		vm.lastErrorKind = ErrorKindCompile
+	case C.WREN_RESULT_RUNTIME_ERROR:
+		vm.lastErrorKind = ErrorKindRuntime
+	}
+	if vm.outputExceeded {
+		vm.lastErrorKind = ErrorKindRuntime
+		return ErrOutputLimit
+	}
+	if vm.callbackErr != nil {
+		vm.lastErrorKind = ErrorKindRuntime
+		return vm.callbackErr
+	}
+	if result == C.WREN_RESULT_COMPILE_ERROR && vm.compileErr != nil {
+		return vm.compileErr
+	}
+	if result == C.WREN_RESULT_RUNTIME_ERROR && vm.importErr != nil {
+		return vm.importErr
+	}
+	if result == C.WREN_RESULT_RUNTIME_ERROR && vm.keepSources && vm.runtimeErr != nil {
+		return vm.runtimeErr
+	}
+	return interpretResultToErr(result)
+}
+
+// ErrorKind is the kind of error, if any, that running Wren code ended with.
+type ErrorKind int
+
+const (
+	ErrorKindNone    ErrorKind = iota // The code ran successfully
+	ErrorKindCompile                  // The code failed to compile
+	ErrorKindRuntime                  // The code failed while running
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindNone:
+		return "None"
+	case ErrorKindCompile:
+		return "Compile"
+	case ErrorKindRuntime:
+		return "Runtime"
+	default:
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+}
+
+// LastErrorKind returns the kind of error that the most recent Interpret or Call (or
+// any of their variants) ended with, or ErrorKindNone if it succeeded. Calls that
+// fail before running any Wren code, such as with ErrReentrant, don't change it.
+func (vm *VM) LastErrorKind() ErrorKind {
+	return vm.lastErrorKind
+}
+
+var (
+	// ErrCompilation is returned when Wren code fails to compile. The error returned
+	// is usually a *CompileError with the details, which matches ErrCompilation
+	// using errors.Is.
+	ErrCompilation = errors.New("compilation error")
+
+	// ErrRuntime is returned when Wren code fails while running.
+	ErrRuntime = errors.New("runtime error")
+)
+
+// CompileError is returned when Wren source fails to compile, describing the first
+// problem the compiler found.
+type CompileError struct {
+	Module  string // The module containing the error, or its display name
+	Line    int    // The line of the error, starting at 1
+	Column  int    // The column of the error, starting at 1, or 0 if unknown
+	Message string // The compiler's description of the error
+	Source  string // The text of the offending line, if available
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("compilation error: %s:%d: %s", e.Module, e.Line, e.Message)
+}
+
+// Is reports the error as an ErrCompilation, so that errors.Is(err, ErrCompilation)
+// holds for every compile error.
+func (e *CompileError) Is(target error) bool {
+	return target == ErrCompilation
+}
+
+// IsIncomplete reports whether err is a compile error caused by the source ending too
+// soon, such as in the middle of a block, an argument list, a string or a comment,
+// rather than by a mistake in it. A REPL can use this to tell when to keep reading
+// lines of input before interpreting them.
+func IsIncomplete(err error) bool {
+	var compileErr *CompileError
+	if !errors.As(err, &compileErr) {
+		return false
+	}
+	// Wren reports running out of tokens against the end of the file, and running
+	// out of input inside a string or comment as "Unterminated ...".
+	return strings.HasPrefix(compileErr.Message, "Error at end of file") ||
+		strings.Contains(compileErr.Message, "Unterminated")
+}
+
+// recordCompileError notes the first compile error reported while interpreting, along
+// with the offending line of source, if it's in the source being interpreted.
+func (vm *VM) recordCompileError(rawModule, module string, line int, message string) {
+	if vm.compileErr != nil {
+		return
+	}
+	err := &CompileError{Module: module, Line: line, Message: message}
+	if vm.source != nil && rawModule == vm.sourceModule && line > 0 {
+		lines := strings.Split(C.GoString(vm.source), "\n")
+		if line <= len(lines) {
+			err.Source = strings.TrimSuffix(lines[line-1], "\r")
+			err.Column = errorColumn(err.Source, message)
+		}
+	}
+	vm.compileErr = err
+}
+
+// errorColumn works out the column of a compile error from Wren's message, which
+// quotes the offending token like "Error at 'foo': ...", by finding that token in
+// the line of source. It returns 0 if there's no token or it can't be found.
+func errorColumn(source, message string) int {
+	const prefix = "Error at '"
+	if !strings.HasPrefix(message, prefix) {
+		return 0
+	}
+	token := message[len(prefix):]
+	end := strings.Index(token, "': ")
+	if end < 0 {
+		return 0
+	}
+	if i := strings.Index(source, token[:end]); i >= 0 {
+		return i + 1
+	}
+	return 0
+}
+
+// RuntimeError is returned when Wren code fails while running, if the virtual machine
+// keeps sources; see KeepSources.
+type RuntimeError struct {
+	Message string       // The message the fiber was aborted with
+	Frames  []StackFrame // The stack at the time of the error, innermost first
+}
+
+// StackFrame is a single frame of a RuntimeError's stack trace.
+type StackFrame struct {
+	Module   string // The module containing the code, or its display name
+	Line     int    // The line being run, starting at 1
+	Function string // The name of the function, or "(script)" for top-level code
+	Source   string // The text of the line, if available
+}
+
+func (e *RuntimeError) Error() string {
+	return "runtime error: " + e.Message
+}
+
+// Is reports the error as an ErrRuntime, so that errors.Is(err, ErrRuntime) holds
+// for every runtime error.
+func (e *RuntimeError) Is(target error) bool {
+	return target == ErrRuntime
+}
+
+// KeepSources controls whether the virtual machine holds on to the source of every
+// module it runs, including those it imports, so that runtime errors can quote it. By
+// default, runtime errors are reported as ErrRuntime; when sources are kept, they're
+// reported as a *RuntimeError instead, with each frame of the stack trace carrying
+// the line of source it refers to, from whichever module that is. Only the most
+// recently interpreted source of the main module is kept, so frames in functions
+// defined by earlier calls to Interpret may quote the wrong line, and modules imported
+// before sources were kept aren't quoted at all.
+func (vm *VM) KeepSources(keep bool) {
+	vm.keepSources = keep
+	if !keep {
+		vm.sources = nil
+	}
+}
+
+// keepSource records the source of a module, if the virtual machine keeps sources,
+// and returns it.
+func (vm *VM) keepSource(module, source string) string {
+	if vm.keepSources {
+		if vm.sources == nil {
+			vm.sources = make(map[string]string)
+		}
+		vm.sources[module] = source
+	}
+	return source
+}
+
+// recordRuntimeError builds up the runtime error being reported, which Wren does
+// in pieces: first the message, then each frame of the stack trace.
+func (vm *VM) recordRuntimeError(errorType C.WrenErrorType, rawModule, module string, line int, message string) {
+	if !vm.keepSources {
+		return
+	}
+	if errorType == C.WREN_ERROR_RUNTIME {
+		vm.runtimeErr = &RuntimeError{Message: message}
+		return
+	}
+	if vm.runtimeErr == nil {
+		return
+	}
+	frame := StackFrame{Module: module, Line: line, Function: message}
+	if lines := strings.Split(vm.sources[rawModule], "\n"); line > 0 && line <= len(lines) {
+		frame.Source = strings.TrimSuffix(lines[line-1], "\r")
+	}
+	vm.runtimeErr.Frames = append(vm.runtimeErr.Frames, frame)
+}
+
+// enter marks the virtual machine as running Wren code, returning ErrReentrant if
+// it already is, or ErrClosed if it's been closed.
+func (vm *VM) enter() error {
+	if vm.vm == nil {
+		return ErrClosed
+	}
+	if vm.running {
+		return ErrReentrant
+	}
+	vm.running = true
+	vm.outputCount, vm.outputExceeded = 0, false
+	vm.callbackErr = nil
+	vm.compileErr, vm.runtimeErr, vm.importErr = nil, nil, nil
+	vm.resolveErr = ""
+	// Imports only nest within a single run, so the chain of importers left over
+	// from an earlier one would only confuse the check for circular imports.
+	vm.importers = make(map[string]string)
+	return nil
+}
+
+// exit marks the virtual machine as no longer running Wren code.
+func (vm *VM) exit() {
+	vm.running = false
+	vm.Flush()
+	vm.observeGC()
+}
+
+// InterpretContext interprets the provided Wren source code, stopping it early if ctx
+// is cancelled before it completes, in which case ctx.Err() is returned. If the script
+// completes anyway, such as when ctx is cancelled after its last call to Go.tick(),
+// its own result is returned instead.
+//
+// Wren has no way to interrupt a running script from the outside, so cancellation is
+// cooperative: it only takes effect when the script calls the built-in foreign method
+// "static Go.tick()", which aborts the current fiber once ctx is done. Scripts that
+// might run for a long time should call it regularly, such as once per loop iteration:
+//
+//     class Go {
+//       foreign static tick()
+//     }
+//
+//     while (true) {
+//       Go.tick()
+//     }
+func (vm *VM) InterpretContext(ctx context.Context, source string) error {
+	return vm.runContext(ctx, func() error {
+		return vm.Interpret(source)
+	})
+}
+
+// InterpretTimeout interprets the provided Wren source code, stopping it if it takes
+// longer than d. The same caveats as InterpretContext apply; in particular, the script
+// must call Go.tick() for the timeout to be able to stop it.
+func (vm *VM) InterpretTimeout(source string, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return vm.InterpretContext(ctx, source)
+}
+
+// installTick registers the built-in Go.tick() foreign method, if it hasn't been already.
+func (vm *VM) installTick() error {
+	if vm.tickInstalled {
+		return nil
+	}
+	if err := vm.RegisterForeignMethod("static Go.tick()", func(vm *VM) {
+		if atomic.LoadInt32(&vm.aborted) != 0 {
+			vm.interrupted = true
+			abortFiber(vm.vm, "script cancelled")
+		} else if vm.outputExceeded {
+			abortFiber(vm.vm, ErrOutputLimit.Error())
+		}
+	}); err != nil {
+		return err
+	}
+	vm.tickInstalled = true
+	return nil
+}
+
+// runContext runs Wren code with run, stopping it early if ctx is cancelled, for
+// InterpretContext and CallContext. It returns ctx.Err() if the cancellation aborted a
+// fiber and the code failed because of it, and otherwise whatever run returns, even
+// if ctx was cancelled after the code had already finished.
+func (vm *VM) runContext(ctx context.Context, run func() error) error {
+	if vm.vm == nil {
+		return ErrClosed
+	}
+	// A nested run would otherwise clear the flags of the one in progress.
+	if vm.running {
+		return ErrReentrant
+	}
+	if err := vm.installTick(); err != nil {
+		return err
+	}
+	stop := vm.watch(ctx)
+	err := run()
+	if stop() && err != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// watch flags the virtual machine as aborted once ctx is done. The returned function
+// stops watching, and reports whether Go.tick() aborted a fiber in the meantime.
+func (vm *VM) watch(ctx context.Context) (stop func() bool) {
+	atomic.StoreInt32(&vm.aborted, 0)
+	vm.interrupted = false
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&vm.aborted, 1)
+		case <-done:
+		}
+	}()
+	return func() bool {
+		// Wait for the watcher to finish, so that it can't flag the virtual
+		// machine after the flag has been cleared.
+		close(done)
+		<-finished
+		atomic.StoreInt32(&vm.aborted, 0)
+		interrupted := vm.interrupted
+		vm.interrupted = false
+		return interrupted
+	}
+}
+
+// resultModule is the module holding the class that InterpretValue passes the values
+// of scripts through.
+const resultModule = "go-wren/result"
+
+// InterpretValue interprets the provided Wren source code and returns the value of its
+// final line, if that line is an expression. Wren itself discards the values of
+// top-level expressions, so this works by rewriting the final line into a call that
+// hands its value back to Go, from within a block of its own so that nothing is added
+// to the main module. If the final line is a statement instead, such as a class
+// definition or a loop, the result is nil.
+//
+// Only the last line that starts outside of any brackets is considered, so an expression
+// that spans several lines is handled as long as the continuation lines are within its
+// brackets, follow a line ending with an operator, or begin with a "." for a method call.
+func (vm *VM) InterpretValue(source string) (interface{}, error) {
+	if err := vm.installResult(); err != nil {
+		return nil, err
+	}
+	c_source := C.CString(source)
+	defer C.free(unsafe.Pointer(c_source))
+	err := vm.interpretRewritten(vm.mainModule, c_source, func(source string) (string, int, int) {
+		start, end, ok := lastExpression(source)
+		if !ok {
+			return source, 0, 0
+		}
+		line := strings.Count(source[:start], "\n") + 1
+		return source[:start] + "{\nimport \"" + resultModule + "\" for GoResult\nGoResult.set_((" +
+			source[start:end] + "))\n}" + source[end:], line, 2
+	})
+	result := vm.lastValue
+	vm.lastValue = nil
+	if result == nil {
+		return nil, err
+	}
+	defer vm.ReleaseValue(result)
+	if err != nil {
+		return nil, err
+	}
+	C.wrenEnsureSlots(vm.vm, 1)
+	C.wrenSetSlotHandle(vm.vm, 0, result.value)
+	return slotResult(vm.vm, 0)
+}
+
+// installResult makes sure that the module holding the GoResult class used by
+// InterpretValue is ready to use.
+func (vm *VM) installResult() error {
+	if vm.vm == nil {
+		return ErrClosed
+	}
+	const name = "static GoResult.set_(_)"
+	if _, ok := vm.internal[name]; !ok {
+		ptr, err := registerFunc(name, func() {
+			defer abortOnPanic(vm.vm)
+			// Converting the value could mean calling back into Wren, which isn't
+			// allowed from a foreign method, so hold on to it until the script is done.
+			vm.lastValue = newValue(vm.vm, 1)
+		})
+		if err != nil {
+			return err
+		}
+		vm.internal[name] = ptr
+	}
+	return vm.LoadOnce(resultModule, "class GoResult {\n  foreign static set_(value)\n}\n")
+}
+
+// statementKeywords are the keywords that begin a statement rather than an expression.
+var statementKeywords = map[string]bool{
+	"break": true, "class": true, "construct": true, "continue": true, "else": true,
+	"for": true, "foreign": true, "if": true, "import": true, "return": true,
+	"static": true, "var": true, "while": true,
+}
+
+// infixOperators are the characters that, at the end of a line, mean that the expression
+// carries on to the next line.
+const infixOperators = "+-*/%<>=!&|^~?:,."
+
+// lastExpression finds the final top-level line of source, returning the range of
+// code it covers through to the end of the source (excluding any trailing comments),
+// and whether it looks like an expression.
+func lastExpression(source string) (start, end int, ok bool) {
+	var (
+		depth        int
+		inString     bool
+		lineComment  bool
+		blockComment int
+		atLineStart  = true
+		last         byte
+	)
+	start, end = -1, -1
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		var next byte
+		if i+1 < len(source) {
+			next = source[i+1]
+		}
+
+		switch {
+		case lineComment:
+			if c == '\n' {
+				lineComment = false
+				atLineStart = true
+			}
+			continue
+
+		case blockComment > 0:
+			if c == '*' && next == '/' {
+				blockComment--
+				i++
+			} else if c == '/' && next == '*' {
+				blockComment++
+				i++
+			}
+			continue
+
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			end, last = i+1, c
+			continue
+		}
+
+		switch c {
+		case '\n':
+			atLineStart = true
+			continue
+		case ' ', '\t', '\r':
+			continue
+		case '/':
+			if next == '/' {
+				lineComment = true
+				i++
+				continue
+			}
+			if next == '*' {
+				blockComment++
+				i++
+				continue
+			}
+		}
+
+		if atLineStart {
+			atLineStart = false
+			// A line carries on the expression before it if it starts with a method
+			// call, or if the line before ended with an operator.
+			if depth == 0 && c != '.' && !strings.ContainsRune(infixOperators, rune(last)) {
+				start = i
+			}
+		}
+		switch c {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case '"':
+			inString = true
+		}
+		end, last = i+1, c
+	}
+
+	if start < 0 || source[start] == '{' || source[start] == '}' {
+		return 0, 0, false
+	}
+	word := source[start:end]
+	if i := strings.IndexFunc(word, func(r rune) bool {
+		return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}); i >= 0 {
+		word = word[:i]
+	}
+	return start, end, !statementKeywords[word]
+}
+
+// InterpretCapture interprets the provided Wren source code, returning everything
+// the script printed instead of writing it to the output writer. The previous
+// output writer is restored afterwards, even if interpretation fails.
+func (vm *VM) InterpretCapture(source string) (stdout string, err error) {
+	var buf bytes.Buffer
+	prevWriter, prevTee, prevFunc := vm.outWriter, vm.teeWriters, vm.outFunc
+	vm.outWriter, vm.teeWriters, vm.outFunc = &buf, nil, nil
+	defer func() {
+		vm.outWriter, vm.teeWriters, vm.outFunc = prevWriter, prevTee, prevFunc
+	}()
+	err = vm.Interpret(source)
+	return buf.String(), err
+}
+
+// InterpretBytes interprets the provided Wren source code as the given module.
+// The source is copied straight into C memory, avoiding the intermediate string
+// conversion that Interpret requires. Since Wren reads the source as a
+// NUL-terminated string, any NUL byte in src marks the end of the source.
+func (vm *VM) InterpretBytes(module string, src []byte) error {
+	c_module := vm.mainModule
+	if module != "main" {
+		c_module = C.CString(module)
+		defer C.free(unsafe.Pointer(c_module))
+	}
+	c_source := (*C.char)(C.malloc(C.size_t(len(src) + 1)))
+	defer C.free(unsafe.Pointer(c_source))
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(c_source)), len(src)+1)
+	copy(buf, src)
+	buf[len(src)] = 0
+	return vm.interpret(c_module, c_source)
+}
+
+// InterpretNamed interprets source as a module with the given name, which is what errors
+// in it are reported against, so in-memory source, such as the output of a transpiler,
+// can be reported against the file it came from. Like any other module, it doesn't see
+// the main module's variables, and once run, other scripts can import it by name. To
+// run source in the main module but report errors against another name, use
+// SetDisplayName instead.
+func (vm *VM) InterpretNamed(name, source string) error {
+	c_module := vm.mainModule
+	if name != "main" {
+		c_module = C.CString(name)
+		defer C.free(unsafe.Pointer(c_module))
+	}
+	c_source := C.CString(source)
+	defer C.free(unsafe.Pointer(c_source))
+	return vm.interpret(c_module, c_source)
+}
+
+// LoadOnce interprets source as the given module unless a previous call to LoadOnce
+// already loaded that module successfully, in which case it does nothing. This makes
+// it cheap to repeatedly ensure that a library module is present; once loaded, the
+// module can be imported by other scripts like any other.
+func (vm *VM) LoadOnce(module, source string) error {
+	if vm.loaded[module] {
+		return nil
+	}
+	if err := vm.InterpretBytes(module, []byte(source)); err != nil {
+		return err
+	}
+	vm.loaded[module] = true
+	return nil
+}
+
+// SetDisplayName sets the name that errors in the main module are reported against,
+// in place of "main", such as the name of the file its source was read from. An empty
+// name restores the default.
+func (vm *VM) SetDisplayName(name string) {
+	vm.displayName = name
+}
+
+// ValidateDir checks that every .wren file in dir and its subdirectories compiles,
+// without running any of them, such as before deploying scripts. Each file is compiled
+// on its own in a fresh virtual machine, and nothing is printed; instead, ValidateDir
+// returns the errors, at most one per file, which are usually *CompileErrors whose
+// Module is the path of the file. An empty result means every file compiled.
+//
+// Since nothing runs, imports aren't followed, and mistakes that Wren only detects at
+// run time, such as calling a method that doesn't exist, aren't caught.
+func ValidateDir(dir string) []error {
+	var errs []error
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if d.IsDir() || filepath.Ext(path) != ".wren" {
+			return nil
+		}
+		if err := validateFile(path); err != nil {
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// validateFile compiles the given file in a fresh virtual machine for ValidateDir.
+func validateFile(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	vm := NewVM()
+	defer vm.Close()
+	vm.SetDisplayName(path)
+	vm.SetErrorFunc(func(errType, module string, line int, msg string) {})
+	return vm.compile(string(contents))
+}
+
+// compile compiles source as the main module without running it. The C API only
+// offers compiling and running together, so this runs it behind a line that aborts the
+// fiber before any of the source itself can run; getting that far means it compiled.
+func (vm *VM) compile(source string) error {
+	c_source := C.CString(source)
+	defer C.free(unsafe.Pointer(c_source))
+	err := vm.interpretRewritten(vm.mainModule, c_source, func(source string) (string, int, int) {
+		return "Fiber.abort(\"compiled\")\n" + source, 0, 1
+	})
+	if vm.LastErrorKind() == ErrorKindRuntime {
+		return nil
+	}
+	return err
+}
+
+// InterpretFile interprets the Wren source code in the provided file. Errors in it are
+// reported against the file's name rather than "main".
+func (vm *VM) InterpretFile(filename string) error {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	prev := vm.displayName
+	vm.displayName = filename
+	defer func() {
+		vm.displayName = prev
+	}()
+	return vm.InterpretBytes("main", contents)
+}
+
+// InterpretReader interprets the Wren source code from the provided reader.
+// Note that the reader must be read fully before interpretation will begin;
+// it's not possible to interpret an infinite stream of input.
+func (vm *VM) InterpretReader(r io.Reader) error {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return vm.InterpretBytes("main", contents)
+}
+
+// InterpretStream interprets Wren source code from the provided reader as it arrives,
+// rather than reading all of it first like InterpretReader. The source is split into
+// chunks at blank lines that fall between top-level statements, and each chunk is
+// interpreted as soon as it's complete, which keeps memory use down for large
+// generated scripts and allows for REPL-like streams that are never closed.
+//
+// A chunk is only complete once it ends outside of any brackets, strings or comments,
+// and not with an operator, such as the + of a sum carrying on to the next line. Even
+// then, a statement may carry on past a blank line, with an else or a method call on
+// a line starting with a ".", so a chunk is only interpreted once the next line that
+// isn't blank arrives and doesn't continue it, or the stream ends.
+//
+// Every chunk is interpreted in the main module, so later chunks can use variables
+// and classes defined by earlier ones, but line numbers in errors are relative to the
+// start of the chunk. Interpretation stops at the first chunk that fails.
+func (vm *VM) InterpretStream(r io.Reader) error {
+	var (
+		br    = bufio.NewReader(r)
+		chunk []byte
+		// Whether chunk is complete, pending the next line that isn't blank.
+		complete bool
+	)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		switch trimmed := bytes.TrimSpace(line); {
+		case len(trimmed) == 0:
+			if len(chunk) > 0 {
+				complete = complete || statementComplete(chunk)
+				chunk = append(chunk, line...)
+			}
+		case complete && !continuesStatement(trimmed):
+			if err := vm.InterpretBytes("main", chunk); err != nil {
+				return err
+			}
+			chunk = append(chunk[:0], line...)
+			complete = false
+		default:
+			chunk = append(chunk, line...)
+			complete = false
+		}
+		if err == io.EOF {
+			if len(bytes.TrimSpace(chunk)) == 0 {
+				return nil
+			}
+			return vm.InterpretBytes("main", chunk)
+		}
+	}
+}
+
+// continuesStatement reports whether a line, with surrounding whitespace trimmed,
+// carries on the statement before it rather than starting a new one.
+func continuesStatement(line []byte) bool {
+	if line[0] == '.' {
+		return true
+	}
+	rest := bytes.TrimPrefix(line, []byte("else"))
+	return len(rest) < len(line) && (len(rest) == 0 || !isNameChar(rest[0]))
+}
+
+// isNameChar reports whether c can be part of a Wren name.
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// statementComplete reports whether source ends outside of any brackets, strings or
+// block comments, and not with an operator, so that it can be interpreted on its own.
+func statementComplete(source []byte) bool {
+	var (
+		depth        int
+		inString     bool
+		lineComment  bool
+		blockComment int
+		last         byte
+	)
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		var next byte
+		if i+1 < len(source) {
+			next = source[i+1]
+		}
+
+		switch {
+		case lineComment:
+			lineComment = c != '\n'
+		case blockComment > 0:
+			if c == '*' && next == '/' {
+				blockComment--
+				i++
+			} else if c == '/' && next == '*' {
+				blockComment++
+				i++
+			}
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			last = c
+		case c == '/' && next == '/':
+			lineComment = true
+			i++
+		case c == '/' && next == '*':
+			blockComment++
+			i++
+		case c == '(' || c == '[' || c == '{':
+			depth++
+			last = c
+		case c == ')' || c == ']' || c == '}':
+			depth--
+			last = c
+		case c == '"':
+			inString = true
+			last = c
+		case c != ' ' && c != '\t' && c != '\r' && c != '\n':
+			last = c
+		}
+	}
+	return depth <= 0 && !inString && blockComment == 0 && !strings.ContainsRune(infixOperators, rune(last))
+}
+
+// TODO: implement this better. It should automatically pick an available
+// slot, then convert the value to something useful.
+func (vm *VM) getVariable(module, name string, slot int) {
+	var (
+		c_module = C.CString(module)
+		c_name   = C.CString(name)
+	)
+	defer func() {
+		C.free(unsafe.Pointer(c_module))
+		C.free(unsafe.Pointer(c_name))
+	}()
+	C.wrenGetVariable(vm.vm, c_module, c_name, C.int(slot))
+}
+
+// Type is the type of a value held in a Wren slot.
+type Type int
+
+const (
+	TypeBool    Type = C.WREN_TYPE_BOOL
+	TypeNum     Type = C.WREN_TYPE_NUM
+	TypeForeign Type = C.WREN_TYPE_FOREIGN
+	TypeList    Type = C.WREN_TYPE_LIST
+	TypeMap     Type = C.WREN_TYPE_MAP
+	TypeNull    Type = C.WREN_TYPE_NULL
+	TypeString  Type = C.WREN_TYPE_STRING
+
+	// TypeUnknown is reported for any object that isn't accessible from C, such
+	// as an instance of a class defined in Wren.
+	TypeUnknown Type = C.WREN_TYPE_UNKNOWN
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeBool:
+		return "Bool"
+	case TypeNum:
+		return "Num"
+	case TypeForeign:
+		return "Foreign"
+	case TypeList:
+		return "List"
+	case TypeMap:
+		return "Map"
+	case TypeNull:
+		return "Null"
+	case TypeString:
+		return "String"
+	case TypeUnknown:
+		return "Unknown"
+	default:
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+}
+
+// SlotType returns the type of the value currently held in the given slot. It's
+// intended for foreign methods that inspect their arguments before deciding how
+// to handle them.
+func (vm *VM) SlotType(slot int) Type {
+	return Type(C.wrenGetSlotType(vm.vm, C.int(slot)))
+}
+
+// Range is a Wren range, such as 1..10 or 0...count, as read by Value.Range. A foreign
+// method can also take one as a parameter, or as a []int of the numbers in it.
+type Range struct {
+	From, To  float64
+	Inclusive bool // Whether To is part of the range, as for 1..10 but not 1...10
+}
+
+// MaxRangeInts is the most numbers that Range.Ints expands a range to, so that a script
+// can't use up all of the memory with a range such as 0..1e15.
+const MaxRangeInts = 1 << 20
+
+// Ints returns the numbers in the range, in the order Wren would iterate over them,
+// counting down if To is less than From. It fails if From or To isn't an integer, or if
+// the range holds more than MaxRangeInts numbers.
+func (r Range) Ints() ([]int, error) {
+	if r.From != math.Trunc(r.From) || r.To != math.Trunc(r.To) || math.IsInf(r.From, 0) || math.IsInf(r.To, 0) {
+		return nil, fmt.Errorf("can't expand %v to integers; its bounds must be integers", r)
+	}
+	count := math.Abs(r.To - r.From)
+	if r.Inclusive {
+		count++
+	}
+	if count > MaxRangeInts {
+		return nil, fmt.Errorf("can't expand %v to integers; it holds more than %d", r, MaxRangeInts)
+	}
+	from, to, step := int(r.From), int(r.To), 1
+	if to < from {
+		step = -1
+	}
+	if !r.Inclusive {
+		if from == to {
+			return []int{}, nil
+		}
+		to -= step
+	}
+	ints := make([]int, 0, (to-from)*step+1)
+	for i := from; ; i += step {
+		ints = append(ints, i)
+		if i == to {
+			return ints, nil
+		}
+	}
+}
+
+func (r Range) String() string {
+	if r.Inclusive {
+		return fmt.Sprintf("%v..%v", r.From, r.To)
+	}
+	return fmt.Sprintf("%v...%v", r.From, r.To)
+}
+
+// Value represents a Wren value that Go has a handle to.
+type Value struct {
+	vmRef
+	value   *C.WrenHandle
+	methods map[string]*C.WrenHandle
+}
+
+// Variable looks up a variable by name and returns its value.
+func (vm *VM) Variable(name string) *Value {
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	C.wrenEnsureSlots(vm.vm, 1)
+	C.wrenGetVariable(vm.vm, vm.mainModule, c_name, 0)
+	return newValue(vm.vm, 0)
+}
+
+// VariableFrom looks up a top-level variable in the given module and returns its
+// value. This includes variables that a module imported from other modules.
+func (vm *VM) VariableFrom(module, name string) (*Value, error) {
+	c_module := C.CString(module)
+	defer C.free(unsafe.Pointer(c_module))
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	if !C.wrenHasModule(vm.vm, c_module) {
+		return nil, fmt.Errorf("module %q has not been loaded", module)
+	}
+	if !C.wrenHasVariable(vm.vm, c_module, c_name) {
+		return nil, fmt.Errorf("module %q has no variable %q", module, name)
+	}
+	C.wrenEnsureSlots(vm.vm, 1)
+	C.wrenGetVariable(vm.vm, c_module, c_name, 0)
+	return newValue(vm.vm, 0), nil
+}
+
+// SetVariable sets the value of a top-level variable in the given module, converting v
+// the same way as the arguments to Call. The variable must already exist, since it's
+// assigned by a function that Wren compiles in that module: declare it in the script
+// first, such as with var limit = null. Like Interpret, it can't be used while Wren is
+// running. Wren resolves the variables a module imports when it imports them, so
+// setting a variable doesn't change the copies that other modules imported earlier.
+func (vm *VM) SetVariable(module, name string, v interface{}) error {
+	c_module := C.CString(module)
+	defer C.free(unsafe.Pointer(c_module))
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	if !C.wrenHasModule(vm.vm, c_module) {
+		return fmt.Errorf("module %q has not been loaded", module)
+	}
+	if !C.wrenHasVariable(vm.vm, c_module, c_name) {
+		return fmt.Errorf("module %q has no variable %q", module, name)
+	}
+
+	// The C API can read variables but not write them, so have Wren make a function
+	// that assigns to it, from within a block so that nothing is added to the module.
+	if err := vm.installResult(); err != nil {
+		return err
+	}
+	param := "value"
+	if name == param {
+		param = "newValue"
+	}
+	err := vm.interpretGenerated(c_module, "{\nimport \""+resultModule+"\" for GoResult\n"+
+		"GoResult.set_(Fn.new {|"+param+"| "+name+" = "+param+" })\n}\n")
+	setter := vm.lastValue
+	vm.lastValue = nil
+	if setter == nil {
+		return err
+	}
+	defer vm.ReleaseValue(setter)
+	if err != nil {
+		return err
+	}
+	_, err = setter.Call("call(_)", v)
+	return err
+}
+
+// Imported looks up several variables from the same module, such as the names that
+// a script imported, keyed by name. It fails if any of them can't be found.
+func (vm *VM) Imported(module string, names ...string) (map[string]*Value, error) {
+	values := make(map[string]*Value, len(names))
+	for _, name := range names {
+		value, err := vm.VariableFrom(module, name)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// newValue creates a handle to the value in the given slot. The handle is
+// released when the returned Value is garbage collected.
+func newValue(vm *C.WrenVM, slot int) *Value {
+	value := Value{vmRef: refVM(vm), value: trackHandle(vm, C.wrenGetSlotHandle(vm, C.int(slot)))}
+	if value.value == nil {
+		return nil
+	}
+	value.methods = make(map[string]*C.WrenHandle)
+	runtime.SetFinalizer(&value, func(value *Value) {
+		for _, method := range value.methods {
+			value.releaseHandle(method)
+		}
+		value.releaseHandle(value.value)
+	})
+	return &value
+}
+
+// Call calls the method with the given signature that belongs to the given value.
+//
+// The receiver should be the value on which the method is defined; a class reference
+// for static methods, and an instance of a class for instance methods. The signature
+// is a standard Wren method signature, and any parameters it expects will follow.
+// Parameters may themselves be *Value, in which case the Wren value they refer to
+// is passed as-is. A parameter that can't be passed, such as one of an unsupported
+// type or a *Value that's been released, makes Call return an error without calling
+// the method.
+//
+// Results that can't be converted to a Go value, such as instances of classes
+// defined in Wren, are returned as a *Value so that further methods can be
+// called on them. A list or map that contains itself can't be converted at all, so
+// Call returns an error for it instead.
+func (v *Value) Call(signature string, params ...interface{}) (interface{}, error) {
+	if err := v.call(signature, params); err != nil {
+		return nil, err
+	}
+	return slotResult(v.vm, 0)
+}
+
+// CallContext calls a method like Call, stopping it early if ctx is cancelled before it
+// completes, in which case ctx.Err() is returned. As with InterpretContext, a method
+// that completes anyway returns its own result.
+//
+// As with InterpretContext, cancellation only takes effect when the method calls
+// Go.tick(). That foreign method is only registered once InterpretContext or
+// CallContext is first used, so a script declaring the Go class before then should be
+// run with InterpretContext, even if only with context.Background().
+func (v *Value) CallContext(ctx context.Context, signature string, params ...interface{}) (interface{}, error) {
+	vm := v.live()
+	if vm == nil {
+		return nil, ErrClosed
+	}
+	var result interface{}
+	err := vm.runContext(ctx, func() (err error) {
+		result, err = v.Call(signature, params...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Get gets the value of a property, by calling the getter with the given name. It's
+// equivalent to calling Call with the property name as the signature, which for a
+// getter has no parentheses; a method taking no arguments, such as "count()", must be
+// called with Call instead.
+func (v *Value) Get(property string) (interface{}, error) {
+	if strings.ContainsAny(property, "([=") {
+		return nil, fmt.Errorf("%q is not a getter name", property)
+	}
+	return v.Call(property)
+}
+
+// Range reads the bounds of the range that the value refers to, by calling its from, to
+// and isInclusive getters. It fails if the value isn't a range. It can't be called from
+// a foreign method, which should take a Range parameter instead.
+func (v *Value) Range() (Range, error) {
+	name, err := v.ClassName()
+	if err != nil {
+		return Range{}, err
+	}
+	if name != "Range" {
+		return Range{}, fmt.Errorf("can't read a %s as a range", name)
+	}
+	from, err := v.Call("from")
+	if err != nil {
+		return Range{}, err
+	}
+	to, err := v.Call("to")
+	if err != nil {
+		return Range{}, err
+	}
+	inclusive, err := v.Call("isInclusive")
+	if err != nil {
+		return Range{}, err
+	}
+	r := Range{Inclusive: inclusive == true}
+	if r.From, err = rangeBound(from); err != nil {
+		return Range{}, err
+	}
+	if r.To, err = rangeBound(to); err != nil {
+		return Range{}, err
+	}
+	return r, nil
+}
+
+// rangeBound converts a bound of a range, as returned by Call, to a float64. It's an
+// int64 if the virtual machine prefers integers.
+func rangeBound(bound interface{}) (float64, error) {
+	switch n := bound.(type) {
+	case float64:
+		return n, nil
+	case int64:
+		return float64(n), nil
+	default:
+		return 0, fmt.Errorf("range bound %v is not a number", bound)
+	}
+}
+
+// Type returns the type of the value, the same way as SlotType does for a slot, so that
+// generic code can decide how to convert it without calling any of its methods. It
+// returns TypeUnknown if the value has been released or its virtual machine closed.
+func (v *Value) Type() Type {
+	if v.value == nil || v.live() == nil {
+		return TypeUnknown
+	}
+	slot := scratchSlots(v.vm, 1)
+	C.wrenSetSlotHandle(v.vm, C.int(slot), v.value)
+	return Type(C.wrenGetSlotType(v.vm, C.int(slot)))
+}
+
+// ListLen returns the number of elements in the list the value refers to, or 0 if it
+// isn't a list. Together with ListAt, it allows stepping through a large list without
+// converting all of it to a Go slice at once.
+func (v *Value) ListLen() int {
+	if v.value == nil || v.live() == nil {
+		return 0
+	}
+	slot := scratchSlots(v.vm, 1)
+	C.wrenSetSlotHandle(v.vm, C.int(slot), v.value)
+	if C.wrenGetSlotType(v.vm, C.int(slot)) != C.WREN_TYPE_LIST {
+		return 0
+	}
+	return int(C.wrenGetListCount(v.vm, C.int(slot)))
+}
+
+// ListAt returns the element at index i of the list the value refers to, converted to a
+// Go value the same way as the result of Call.
+func (v *Value) ListAt(i int) (interface{}, error) {
+	if v.value == nil {
+		return nil, ErrReleased
+	}
+	if v.live() == nil {
+		return nil, ErrClosed
+	}
+	slot := scratchSlots(v.vm, 2)
+	C.wrenSetSlotHandle(v.vm, C.int(slot), v.value)
+	if C.wrenGetSlotType(v.vm, C.int(slot)) != C.WREN_TYPE_LIST {
+		return nil, errors.New("value is not a list")
+	}
+	if n := int(C.wrenGetListCount(v.vm, C.int(slot))); i < 0 || i >= n {
+		return nil, fmt.Errorf("index %d out of range for list of length %d", i, n)
+	}
+	C.wrenGetListElement(v.vm, C.int(slot), C.int(i), C.int(slot+1))
+	return slotResult(v.vm, slot+1)
+}
+
+// slotResult converts the value in the given slot to a Go value. Lists and maps are
+// converted to []interface{} and map[interface{}]interface{}, with their contents
+// converted the same way. Values that can't be converted are returned as a *Value
+// instead. Converting lists and maps may overwrite any slot.
+func slotResult(vm *C.WrenVM, slot int) (interface{}, error) {
+	return nestedResult(vm, slot, 0)
+}
+
+// maxResultDepth is how deeply slotResult follows lists and maps nested within each
+// other, so that one that contains itself fails instead of being followed forever.
+const maxResultDepth = 1000
+
+// nestedResult is slotResult for a value nested depth lists or maps deep.
+func nestedResult(vm *C.WrenVM, slot, depth int) (interface{}, error) {
+	switch C.wrenGetSlotType(vm, C.int(slot)) {
+	case C.WREN_TYPE_FOREIGN:
+		if x, ok := lookupVM(vm).refs[C.wrenGetSlotForeign(vm, C.int(slot))]; ok {
+			return x, nil
+		}
+		return newValue(vm, slot), nil
+
+	case C.WREN_TYPE_UNKNOWN:
+		return newValue(vm, slot), nil
+
+	case C.WREN_TYPE_LIST, C.WREN_TYPE_MAP:
+		if depth >= maxResultDepth {
+			return nil, fmt.Errorf("can't convert lists or maps nested more than %d deep; one may contain itself", maxResultDepth)
+		}
+		if C.wrenGetSlotType(vm, C.int(slot)) == C.WREN_TYPE_LIST {
+			return listResult(vm, slot, depth+1)
+		}
+		return mapResult(vm, slot, depth+1)
+	}
+	if retval := getFromSlot(vm, slot, noShape, nil); retval.IsValid() {
+		return retval.Interface(), nil
+	}
+	return nil, nil
+}
+
+// listResult converts the list in the given slot to a slice for slotResult. The
+// list is held by a handle throughout, since converting its elements may clobber
+// the slots.
+func listResult(vm *C.WrenVM, slot, depth int) ([]interface{}, error) {
+	list := C.wrenGetSlotHandle(vm, C.int(slot))
+	defer C.wrenReleaseHandle(vm, list)
+
+	result := make([]interface{}, int(C.wrenGetListCount(vm, C.int(slot))))
+	for i := range result {
+		C.wrenEnsureSlots(vm, 2)
+		C.wrenSetSlotHandle(vm, 0, list)
+		C.wrenGetListElement(vm, 0, C.int(i), 1)
+		element, err := nestedResult(vm, 1, depth)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = element
+	}
+	return result, nil
+}
+
+// mapResult converts the map in the given slot to a Go map for slotResult.
+func mapResult(vm *C.WrenVM, slot, depth int) (map[interface{}]interface{}, error) {
+	m := C.wrenGetSlotHandle(vm, C.int(slot))
+	defer C.wrenReleaseHandle(vm, m)
+
+	// The C API has no way to enumerate a map's keys, so ask Wren for them.
+	count := int(C.wrenGetMapCount(vm, C.int(slot)))
+	C.wrenSetSlotHandle(vm, 0, m)
+	for _, signature := range []string{"keys", "toList"} {
+		c_signature := C.CString(signature)
+		method := C.wrenMakeCallHandle(vm, c_signature)
+		C.free(unsafe.Pointer(c_signature))
+		err := interpretResultToErr(C.wrenCall(vm, method))
+		C.wrenReleaseHandle(vm, method)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the keys of a map: %w", err)
+		}
+	}
+	keys := C.wrenGetSlotHandle(vm, 0)
+	defer C.wrenReleaseHandle(vm, keys)
+
+	result := make(map[interface{}]interface{}, count)
+	for i := 0; i < count; i++ {
+		C.wrenEnsureSlots(vm, 3)
+		C.wrenSetSlotHandle(vm, 0, keys)
+		C.wrenGetListElement(vm, 0, C.int(i), 1)
+		key, err := nestedResult(vm, 1, depth)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && !reflect.TypeOf(key).Comparable() {
+			return nil, fmt.Errorf("can't use a map key of type %T as a Go map key", key)
+		}
+
+		C.wrenEnsureSlots(vm, 3)
+		C.wrenSetSlotHandle(vm, 0, keys)
+		C.wrenGetListElement(vm, 0, C.int(i), 1)
+		C.wrenSetSlotHandle(vm, 2, m)
+		C.wrenGetMapValue(vm, 2, 1, 0)
+		if result[key], err = nestedResult(vm, 0, depth); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// CallValue calls a method like Call, but always returns the result as a *Value
+// rather than converting it to a Go value. This makes it possible to keep calling
+// methods on whatever the method returned.
+func (v *Value) CallValue(signature string, params ...interface{}) (*Value, error) {
+	if err := v.call(signature, params); err != nil {
+		return nil, err
+	}
+	return newValue(v.vm, 0), nil
+}
+
+// String returns the result of calling toString on the value, so that values can be
+// printed. If that fails, a placeholder is returned instead.
+func (v *Value) String() string {
+	if v == nil {
+		return "null"
+	}
+	str, err := v.Call("toString")
+	if s, ok := str.(string); err == nil && ok {
+		return s
+	}
+	return "<wren value>"
+}
+
+// Equals reports whether the value is equal to another according to Wren's ==(_)
+// operator, which classes may override.
+func (v *Value) Equals(other *Value) (bool, error) {
+	result, err := v.Call("==(_)", other)
+	if err != nil {
+		return false, err
+	}
+	equal, _ := result.(bool)
+	return equal, nil
+}
+
+// Same reports whether the value and another refer to the very same Wren object,
+// regardless of how either class defines equality. Separate handles to the same
+// object are considered the same, so this uses Wren's Object.same(_,_) rather than
+// comparing the handles themselves. The handles needed to call it are made the first
+// time, and kept until the virtual machine is closed or reset.
+func (v *Value) Same(other *Value) bool {
+	if v == nil || other == nil {
+		return v == other
+	}
+	vm := v.live()
+	if vm == nil || v.vmRef != other.vmRef {
+		return false
+	}
+	object, same, err := vm.sameHandles()
+	if err != nil {
+		return false
+	}
+	result, err := same.Call(object, v, other)
+	return err == nil && result == true
+}
+
+// sameHandles returns the Object class and a call handle for its same(_,_) method,
+// making them if they haven't been since the virtual machine was created or reset.
+func (vm *VM) sameHandles() (*Value, *CallHandle, error) {
+	if vm.objectClass == nil || vm.objectClass.live() == nil {
+		// Every module can see the core classes, so take Object from one that's
+		// always there for the loading, rather than from main.
+		if err := vm.installResult(); err != nil {
+			return nil, nil, err
+		}
+		object, err := vm.VariableFrom(resultModule, "Object")
+		if err != nil {
+			return nil, nil, err
+		}
+		vm.objectClass, vm.sameCall = object, vm.MakeCallHandle("same(_,_)")
+	}
+	return vm.objectClass, vm.sameCall, nil
+}
+
+// ClassName returns the name of the value's class, as given by the name of its type
+// property, such as "List" for a list or the name of a class defined in Wren for its
+// instances. A class's own class is its metaclass, named with the suffix " metaclass".
+func (v *Value) ClassName() (string, error) {
+	class, err := v.CallValue("type")
+	if err != nil {
+		return "", err
+	}
+	defer v.live().ReleaseValue(class)
+	name, err := class.Call("name")
+	if err != nil {
+		return "", err
+	}
+	s, ok := name.(string)
+	if !ok {
+		return "", fmt.Errorf("class name is %T, not a string", name)
+	}
+	return s, nil
+}
+
+// call calls a method on the value, leaving the result in slot 0.
+func (v *Value) call(signature string, params []interface{}) error {
+	if v.value == nil {
+		return ErrReleased
+	}
+	if v.live() == nil {
+		return ErrClosed
+	}
+	if err := checkArguments(signature, len(params)); err != nil {
+		return err
+	}
+	f := v.methods[signature]
+	if f == nil {
+		c_signature := C.CString(signature)
+		defer C.free(unsafe.Pointer(c_signature))
+		f = trackHandle(v.vm, C.wrenMakeCallHandle(v.vm, c_signature))
+		v.methods[signature] = f
+	}
+	return v.callHandle(f, params)
+}
+
+// callHandle calls a method on the value using an existing call handle,
+// leaving the result in slot 0.
+func (v *Value) callHandle(f *C.WrenHandle, params []interface{}) error {
+	vm := v.live()
+	if vm == nil {
+		return ErrClosed
+	}
+	if err := vm.enter(); err != nil {
+		return err
+	}
+	defer vm.exit()
+
+	C.wrenEnsureSlots(v.vm, C.int(len(params)+1))
+	C.wrenSetSlotHandle(v.vm, 0, v.value)
+	if err := saveParams(v.vm, params); err != nil {
+		return err
+	}
+	return vm.resultToErr(C.wrenCall(v.vm, f))
+}
+
+// saveParams saves the parameters of a call to the slots from 1 onwards, returning an
+// error for any that can't be converted, rather than panicking like saveToSlot.
+func saveParams(vm *C.WrenVM, params []interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if err, _ = r.(error); err == nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	for i, param := range params {
+		saveToSlot(vm, i+1, reflect.ValueOf(param))
+	}
+	return nil
+}
+
+// maxArguments is the most arguments a Wren method can take.
+const maxArguments = 16
+
+// signatureArity returns the number of arguments taken by methods with the given
+// signature.
+func signatureArity(signature string) int {
+	if i := strings.IndexAny(signature, "(["); i >= 0 {
+		return strings.Count(signature[i:], "_")
+	}
+	return 0
+}
+
+// checkArguments checks that n arguments are right for calling a method with the
+// given signature, before any slots are set aside for them.
+func checkArguments(signature string, n int) error {
+	if n > maxArguments {
+		return fmt.Errorf("%d arguments given, but Wren methods take at most %d", n, maxArguments)
+	}
+	if arity := signatureArity(signature); n != arity {
+		return fmt.Errorf("%s takes %d arguments, but %d were given", signature, arity, n)
+	}
+	return nil
+}
+
+// ErrReleased is returned when using a Value or CallHandle that has already been released.
+var ErrReleased = errors.New("handle has already been released")
+
+// ReleaseValue releases the handle to a Wren value immediately, rather than waiting
+// for the Value to be garbage collected, along with any call handles it has cached.
+// The Value may not be used afterwards.
+func (vm *VM) ReleaseValue(v *Value) {
+	if v == nil || v.value == nil {
+		return
+	}
+	runtime.SetFinalizer(v, nil)
+	for signature, method := range v.methods {
+		v.releaseHandle(method)
+		delete(v.methods, signature)
+	}
+	v.releaseHandle(v.value)
+	v.value = nil
+}
+
+// CallHandle is a handle to a method signature that can be called on any receiver.
+//
+// Values cache the call handles they need automatically, so this is only useful for
+// hosts that call the same method on many different receivers, or that want to
+// control exactly when handles are released.
+type CallHandle struct {
+	vmRef
+	handle    *C.WrenHandle
+	signature string
+}
+
+// MakeCallHandle creates a handle for calling methods with the given signature. The
+// handle is released when it's garbage collected, or explicitly by calling Release.
+func (vm *VM) MakeCallHandle(signature string) *CallHandle {
+	c_signature := C.CString(signature)
+	defer C.free(unsafe.Pointer(c_signature))
+
+	h := &CallHandle{
+		vmRef:     refVM(vm.vm),
+		handle:    trackHandle(vm.vm, C.wrenMakeCallHandle(vm.vm, c_signature)),
+		signature: signature,
+	}
+	runtime.SetFinalizer(h, func(h *CallHandle) {
+		h.releaseHandle(h.handle)
+	})
+	return h
+}
+
+// ErrNoReceiver is returned when calling a CallHandle without a receiver.
+var ErrNoReceiver = errors.New("no receiver given for call")
+
+// Call calls the method on the given receiver, converting the parameters and the result
+// like Value.Call.
+func (h *CallHandle) Call(receiver *Value, params ...interface{}) (interface{}, error) {
+	if receiver == nil {
+		return nil, ErrNoReceiver
+	}
+	if h == nil || h.handle == nil || receiver.value == nil {
+		return nil, ErrReleased
+	}
+	if receiver.vmRef != h.vmRef {
+		return nil, errors.New("can't call a handle on a value from another virtual machine")
+	}
+	if err := checkArguments(h.signature, len(params)); err != nil {
+		return nil, err
+	}
+	if err := receiver.callHandle(h.handle, params); err != nil {
+		return nil, err
+	}
+	return slotResult(h.vm, 0)
+}
+
+// Signature returns the method signature the handle calls.
+func (h *CallHandle) Signature() string {
+	return h.signature
+}
+
+// Release releases the handle immediately. The handle may not be used afterwards.
+func (h *CallHandle) Release() {
+	if h.handle == nil {
+		return
+	}
+	runtime.SetFinalizer(h, nil)
+	h.releaseHandle(h.handle)
+	h.handle = nil
+}
+
+// isInternalModule reports whether module is one of the package's own modules, whose
+// foreign methods and classes are bound to its internal registrations rather than to
+// those made by the user.
+func isInternalModule(module string) bool {
+	return module == internalModule || module == gcModule || module == resultModule || module == foreignModule
+}
+
+// internalModule is the module holding the Wren side of features implemented by
+// this package, such as WrapFunc, out of the way of scripts' own names.
+const internalModule = "go-wren"
+
+// goFunc is the Go side of a function wrapped by WrapFunc.
+type goFunc struct {
+	fn reflect.Value
+}
+
+// goFuncSource declares the class of functions wrapped by WrapFunc. It has a call
+// method for every arity Wren supports, each of which passes its arguments along as
+// a list.
+var goFuncSource = func() string {
+	var src strings.Builder
+	src.WriteString("foreign class GoFunc {\n  foreign invoke_(args)\n")
+	for arity := 0; arity <= maxArguments; arity++ {
+		args := make([]string, arity)
+		for i := range args {
+			args[i] = fmt.Sprintf("a%d", i)
+		}
+		fmt.Fprintf(&src, "  call(%[1]s) { invoke_([%[1]s]) }\n", strings.Join(args, ", "))
+	}
+	src.WriteString("}\n")
+	return src.String()
+}()
+
+// WrapFunc wraps a Go function so that it can be passed to Wren and called like a
+// Wren function, with f.call(...). This allows Go functions to be used anywhere Wren
+// expects a function, such as list.map(f) or list.sort(f).
+//
+// The function's parameters and results are converted the same way as those of a
+// foreign method, though there's no receiver. It must be called with exactly as many
+// arguments as it has parameters, or at least one fewer for variadic functions, up to
+// Wren's limit of 16; calling it with the wrong number of arguments aborts the calling
+// fiber, as does a panic or a non-nil trailing error result.
+//
+// WrapFunc panics if f isn't a function. It must not be called from within a foreign
+// method the first time it's used on a virtual machine, since that loads the Wren
+// code it relies on.
+func (vm *VM) WrapFunc(f interface{}) *Value {
+	fv := reflect.ValueOf(f)
+	if fv.Kind() != reflect.Func {
+		panic(fmt.Sprintf("WrapFunc: expected a function, got %T", f))
+	}
+	if err := vm.installFuncs(); err != nil {
+		panic(fmt.Sprintf("WrapFunc: %v", err))
+	}
+
+	c_module := C.CString(internalModule)
+	defer C.free(unsafe.Pointer(c_module))
+	c_className := C.CString("GoFunc")
+	defer C.free(unsafe.Pointer(c_className))
+
+	scratch := scratchSlots(vm.vm, 2)
+	C.wrenGetVariable(vm.vm, c_module, c_className, C.int(scratch))
+	newForeignRef(vm.vm, scratch+1, scratch, &goFunc{fn: fv})
+	return newValue(vm.vm, scratch+1)
+}
+
+// installFuncs makes sure that the GoFunc class used by WrapFunc is ready to use.
+func (vm *VM) installFuncs() error {
+	if _, ok := vm.internal["GoFunc"]; !ok {
+		alloc, err := registerFunc("GoFunc", func() {
+			abortFiber(vm.vm, "Go functions can only be created with WrapFunc")
+		})
+		if err != nil {
+			return err
+		}
+		invoke, err := registerFunc("GoFunc.invoke_(_)", func() {
+			defer abortOnPanic(vm.vm)
+			if err := invokeFunc(vm.vm); err != nil {
+				abortFiber(vm.vm, err.Error())
+			}
+		})
+		if err != nil {
+			unregisterFunc(alloc)
+			return err
+		}
+		vm.internal["GoFunc"] = alloc
+		vm.internal["GoFunc.invoke_(_)"] = invoke
+	}
+	return vm.LoadOnce(internalModule, goFuncSource)
+}
+
+// invokeFunc calls a function wrapped by WrapFunc, with the receiver in slot 0 and
+// the list of arguments in slot 1.
+func invokeFunc(vm *C.WrenVM) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	w := lookupVM(vm).refs[C.wrenGetSlotForeign(vm, 0)].(*goFunc)
+	var (
+		ft      = w.fn.Type()
+		n       = int(C.wrenGetListCount(vm, 1))
+		params  = make([]reflect.Value, n)
+		scratch = scratchSlots(vm, 1)
+	)
+	if ft.IsVariadic() && n < ft.NumIn()-1 {
+		return fmt.Errorf("function expects at least %d arguments, got %d", ft.NumIn()-1, n)
+	} else if !ft.IsVariadic() && n != ft.NumIn() {
+		return fmt.Errorf("function expects %d arguments, got %d", ft.NumIn(), n)
+	}
+
+	for i := range params {
+		var it reflect.Type
+		if ft.IsVariadic() && i >= ft.NumIn()-1 {
+			it = ft.In(ft.NumIn() - 1).Elem()
+		} else {
+			it = ft.In(i)
+		}
+		C.wrenGetListElement(vm, 1, C.int(i), C.int(scratch))
+		if params[i] = getFromSlot(vm, scratch, noShape, &it); !params[i].IsValid() {
+			params[i] = reflect.Zero(it)
+		}
+	}
+	return saveResults(vm, ft, w.fn.Call(params))
+}
+
+// foreignModule is the module holding the class through which foreign methods that need
+// the keys of maps passed to them are called; see wrapForeign.
+const foreignModule = "go-wren/foreign"
+
+// foreignImport is the line importing GoForeign into a module declaring such methods.
+const foreignImport = "import \"" + foreignModule + "\" for GoForeign\n"
+
+// goForeignSource declares GoForeign. call_ is what the methods declared by wrapForeign
+// call, and it passes their arguments along to invoke_ with their shapes: the shape of
+// a map is a list of its keys along with the shapes of its values, that of a list is
+// the shapes of its elements, and either is null if there's nothing in it with a shape.
+// The shape of a range is its bounds.
+var goForeignSource = fmt.Sprintf(`class GoForeign {
+  static call_(name, receiver, args) { invoke_(name, receiver, args, shapes_(args, 0)) }
+  static shapes_(values, depth) {
+    var shapes = values.map {|value| shape_(value, depth) }.toList
+    for (shape in shapes) {
+      if (shape != null) return shapes
+    }
+    return null
+  }
+  static shape_(value, depth) {
+    if (depth >= %[1]d) {
+      Fiber.abort("can't pass lists or maps nested more than %[1]d deep to a foreign method; one may contain itself")
+    }
+    if (value is Map) {
+      var keys = value.keys.toList
+      return [keys, shapes_(keys.map {|key| value[key] }, depth + 1)]
+    }
+    if (value is List) return shapes_(value, depth + 1)
+    if (value is Range) return [value.from, value.to, value.isInclusive]
+    return null
+  }
+  foreign static invoke_(name, receiver, args, shapes)
+}
+`, maxResultDepth)
+
+// installForeign makes sure that the GoForeign class used by the methods declared by
+// wrapForeign is ready to use.
+func (vm *VM) installForeign() error {
+	const name = "static GoForeign.invoke_(_,_,_,_)"
+	if _, ok := vm.internal[name]; !ok {
+		ptr, err := registerFunc(name, func() {
+			defer abortOnPanic(vm.vm)
+			if err := vm.invokeShaped(); err != nil {
+				abortFiber(vm.vm, err.Error())
+			}
+		})
+		if err != nil {
+			return err
+		}
+		vm.internal[name] = ptr
+	}
+	return vm.LoadOnce(foreignModule, goForeignSource)
+}
+
+// importForeign imports GoForeign into the given module ahead of running source that
+// wrapForeign rewrote, unless the module already has it. This is done separately so
+// that the lines of the source stay where they are.
+func (vm *VM) importForeign(c_module *C.char) error {
+	c_name := C.CString("GoForeign")
+	defer C.free(unsafe.Pointer(c_name))
+	if C.wrenHasModule(vm.vm, c_module) && C.wrenHasVariable(vm.vm, c_module, c_name) {
+		return nil
+	}
+	c_source := C.CString(foreignImport)
+	defer C.free(unsafe.Pointer(c_source))
+	return vm.resultToErr(C.wrenInterpret(vm.vm, c_module, c_source))
+}
+
+// wrapImported is wrapForeign for the source of an imported module, which has nowhere
+// else to import GoForeign but in a line of its own at the top. writeErr makes up for
+// the line when reporting errors in the module.
+func (vm *VM) wrapImported(module, source string) string {
+	if !vm.loaded[foreignModule] || isInternalModule(module) {
+		return source
+	}
+	wrapped, ok := vm.wrapForeign(source)
+	if !ok {
+		return source
+	}
+	vm.preluded[module] = true
+	return foreignImport + wrapped
+}
+
+// invokeShaped calls the function registered under the name in slot 1 for a method or
+// constructor declared by wrapForeign, from GoForeign.invoke_. The receiver is in slot
+// 2, the list of arguments in slot 3, and the list of their shapes, or null, in slot 4.
+func (vm *VM) invokeShaped() error {
+	name := C.GoString(C.wrenGetSlotString(vm.vm, 1))
+	f, ok := vm.shaped[name]
+	if !ok {
+		return fmt.Errorf("%s is no longer registered", name)
+	}
+
+	// Lay the slots out the way a foreign method's are, with the receiver in slot 0
+	// followed by the arguments, then followed by their shapes.
+	var handles [3]*C.WrenHandle
+	for i := range handles {
+		handles[i] = C.wrenGetSlotHandle(vm.vm, C.int(i+2))
+		defer C.wrenReleaseHandle(vm.vm, handles[i])
+	}
+	receiver, args, shapes := handles[0], handles[1], handles[2]
+	n := int(C.wrenGetListCount(vm.vm, 3))
+	base := noShape
+	if C.wrenGetSlotType(vm.vm, 4) != C.WREN_TYPE_NULL {
+		base = n + 1
+	}
+	scratch := 2*n + 1
+	C.wrenEnsureSlots(vm.vm, C.int(scratch+1))
+	C.wrenSetSlotHandle(vm.vm, C.int(scratch), args)
+	for i := 0; i < n; i++ {
+		C.wrenGetListElement(vm.vm, C.int(scratch), C.int(i), C.int(i+1))
+	}
+	if base != noShape {
+		C.wrenSetSlotHandle(vm.vm, C.int(scratch), shapes)
+		for i := 0; i < n; i++ {
+			C.wrenGetListElement(vm.vm, C.int(scratch), C.int(i), C.int(base+i))
+		}
+	}
+	C.wrenSetSlotHandle(vm.vm, 0, receiver)
+
+	if strings.Contains(name, ".") {
+		return vm.callForeign(name, f, n, base)
+	}
+	return construct(vm.vm, f, n, base)
+}
+
+// newForeign allocates a new foreign object.
+//
+// It takes an instance of the VM and a newly allocated foreign object ("foreign"
+// meaning that it's created in Go and not Wren) and makes it available to Wren,
+// as an instance of the class in classSlot stored in slot. From a foreign class
+// allocation function, both of those are slot 0.
+func newForeign(vm *C.WrenVM, slot, classSlot int, x interface{}) {
+	if x == nil {
+		panic("foreign class value must not be nil")
+	}
+	var (
+		v   = reflect.Indirect(reflect.ValueOf(x))
+		t   = v.Type()
+		ptr = C.wrenSetSlotNewForeign(vm, C.int(slot), C.int(classSlot), C.size_t(t.Size()))
+	)
+	reflect.NewAt(t, ptr).Elem().Set(v)
+}
+
+// newForeignRef allocates a new foreign object that refers to a Go pointer.
+//
+// Rather than copying x into Wren's memory the way newForeign does, the Wren
+// object only holds a pointer back to its VM, and its address is used as the key
+// that pins x in the VM's reference table until finalizeRef is called.
+func newForeignRef(vm *C.WrenVM, slot, classSlot int, x interface{}) {
+	if reflect.ValueOf(x).Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("foreign class reference must be a pointer, got %T", x))
+	}
+	ptr := C.wrenSetSlotNewForeign(vm, C.int(slot), C.int(classSlot), C.size_t(unsafe.Sizeof(vm)))
+	*(**C.WrenVM)(ptr) = vm
+	lookupVM(vm).refs[ptr] = x
+}
+
+//export finalizeRef
+func finalizeRef(data unsafe.Pointer) {
+	if v := lookupVM(*(**C.WrenVM)(data)); v != nil {
+		delete(v.refs, data)
+	}
+}
+
+// withStack adds the stack of the current goroutine to err, which describes a panic
+// that's being recovered from, if the virtual machine is in debug mode.
+func withStack(vm *C.WrenVM, err error) error {
+	if v := lookupVM(vm); v == nil || !v.debug {
+		return err
+	}
+	buf := make([]byte, 64<<10)
+	return fmt.Errorf("%w\n\n%s", err, buf[:runtime.Stack(buf, false)])
+}
+
+// abortOnPanic recovers from a panic in a function called by Wren, such as a foreign
+// method or a foreign class's allocator, and aborts the current fiber with its message
+// instead, since letting it unwind through Wren's C stack would crash the program. It
+// must be deferred directly by the function that Wren calls.
+func abortOnPanic(vm *C.WrenVM) {
+	if r := recover(); r != nil {
+		abortFiber(vm, withStack(vm, fmt.Errorf("%v", r)).Error())
+	}
+}
+
+// recoverCallback recovers from a panic in a function called by Wren outside of any
+// foreign method, such as the one writing its output, where abortOnPanic can't abort
+// a fiber. The panic is returned as an error once the Wren code that was running
+// finishes, and until then, foreign methods fail with it and output is dropped. It
+// must be deferred directly by the function that Wren calls.
+func (vm *VM) recoverCallback(what string) {
+	if r := recover(); r != nil && vm.callbackErr == nil {
+		vm.callbackErr = fmt.Errorf("%s panicked: %v", what, r)
+	}
+}
+
+// abortFiber aborts the currently running fiber with the given error message. It
+// must only be called from within a foreign method.
+func abortFiber(vm *C.WrenVM, msg string) {
+	c_msg := C.CString(msg)
+	defer C.free(unsafe.Pointer(c_msg))
+	C.wrenEnsureSlots(vm, 1)
+	C.wrenSetSlotString(vm, 0, c_msg)
+	C.wrenAbortFiber(vm, 0)
+}
+
+var (
+	vmType    = reflect.TypeOf((*VM)(nil))
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// handleFunction is a helper method for foreign methods.
+//
+// This method takes two parameters: a reference to the virtual machine instance
+// (which should be the only parameter provided in the C-exported callback)
+// and a Go function. The function's signature must match the one expected by Wren.
+// If it doesn't, this call will return an error, which aborts the calling fiber.
+// The function may optionally take a *VM as its first parameter, ahead of the
+// receiver, to get access to the virtual machine that called it.
+//
+// The receiver is in slot 0, followed by the given number of arguments. If shapes isn't
+// noShape, the shape of each argument follows them, starting from slot shapes.
+//
+// For examples, check out the test package.
+func handleFunction(vm *C.WrenVM, f interface{}, given, shapes int) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			// Fuck.
@@ -302,6 +3546,7 @@ func handleFunction(vm *C.WrenVM, f interface{}) (err error) {
 			default:
 				err = fmt.Errorf("%v", x)
 			}
+			err = withStack(vm, err)
 		}
 	}()
 
@@ -309,39 +3554,176 @@ func handleFunction(vm *C.WrenVM, f interface{}) (err error) {
 		fv     = reflect.ValueOf(f)
 		ft     = fv.Type()
 		params = make([]reflect.Value, ft.NumIn())
+		first  int
 	)
 
+	// A leading *VM parameter is given the virtual machine itself rather than
+	// a value from a slot.
+	if ft.NumIn() > 0 && ft.In(0) == vmType {
+		params[0] = reflect.ValueOf(lookupVM(vm))
+		first = 1
+	}
+
+	if lookupVM(vm).strictArity {
+		takes := ft.NumIn() - first
+		if takes > 0 && C.wrenGetSlotType(vm, 0) != C.WREN_TYPE_UNKNOWN {
+			takes-- // the receiver
+		}
+		if takes != given {
+			return fmt.Errorf("foreign method takes %d arguments, but was given %d", takes, given)
+		}
+	}
+
 	var offset int
-	for i := 0; i < ft.NumIn(); i++ {
-		slot := i + offset
+	for i := first; i < ft.NumIn(); i++ {
+		slot := i - first + offset
 
 		// If the receiver value is inaccessible from C, it likely just means that
 		// it's a native class with a foreign method. Rather than panic, we simply
 		// advance to the first parameter and continue from there.
-		if i == 0 && C.wrenGetSlotType(vm, C.int(slot)) == C.WREN_TYPE_UNKNOWN {
+		if i == first && C.wrenGetSlotType(vm, C.int(slot)) == C.WREN_TYPE_UNKNOWN {
 			offset++
 			slot++
 		}
 
-		it := ft.In(i)
-		params[i] = getFromSlot(vm, slot, &it)
+		it := ft.In(i)
+		if slot > given {
+			// Missing arguments, which only a lenient arity allows.
+			params[i] = reflect.Zero(it)
+			continue
+		}
+		shape := noShape
+		if slot > 0 {
+			shape = argShape(shapes, slot-1)
+		}
+		if params[i] = getFromSlot(vm, slot, shape, &it); !params[i].IsValid() {
+			// Null arguments, such as the first iterator passed to iterate(_).
+			params[i] = reflect.Zero(it)
+		}
+	}
+
+	return saveResults(vm, ft, fv.Call(params))
+}
+
+// argShape returns the slot holding the shape of argument i, given the first of those
+// slots as passed to handleFunction.
+func argShape(shapes, i int) int {
+	if shapes == noShape {
+		return noShape
+	}
+	return shapes + i
+}
+
+// saveResults saves the results of calling a function of type ft to slot 0 as the
+// return value of a foreign method. A trailing error is returned rather than saved,
+// a (value, ok) pair saves the value or null if the virtual machine has optional
+// results enabled, other multiple results are packed into a list, and no results at
+// all save null.
+func saveResults(vm *C.WrenVM, ft reflect.Type, returnValues []reflect.Value) error {
+	if n := len(returnValues); n > 0 && ft.Out(n-1) == errorType {
+		if e := returnValues[n-1]; !e.IsNil() {
+			return e.Interface().(error)
+		}
+		returnValues = returnValues[:n-1]
+	}
+	if len(returnValues) == 2 && ft.Out(1).Kind() == reflect.Bool && lookupVM(vm).optionalResults {
+		if !returnValues[1].Bool() {
+			C.wrenSetSlotNull(vm, 0)
+			return nil
+		}
+		returnValues = returnValues[:1]
 	}
 
-	returnValues := fv.Call(params)
-	// TODO: allow returning a second value if it's an `error`, like the template packages
-	if len(returnValues) == 1 {
+	switch len(returnValues) {
+	case 0:
+		// Otherwise the receiver, which is still in slot 0, would be returned.
+		C.wrenSetSlotNull(vm, 0)
+	case 1:
 		saveToSlot(vm, 0, returnValues[0])
+
+	default:
+		// Multiple results are packed into a list.
+		results := make([]interface{}, len(returnValues))
+		for i, rv := range returnValues {
+			results[i] = rv.Interface()
+		}
+		saveToSlot(vm, 0, reflect.ValueOf(results))
 	}
-	return
+	return nil
 }
 
 //export write
 func write(vm *C.WrenVM, text *C.char) {
-	out := vmMap[vm].outWriter
-	if out == nil {
-		out = os.Stdout
+	v := lookupVM(vm)
+	defer v.recoverCallback("writing output")
+	if v.callbackErr != nil {
+		return
+	}
+	str := v.limitOutput(C.GoString(text))
+	if str == "" {
+		return
+	}
+	if fn := v.outFunc; fn != nil {
+		fn(str)
+		return
+	}
+	for _, out := range v.teeWriters {
+		fmt.Fprint(out, str)
+	}
+	if out := v.outWriter; out != nil {
+		fmt.Fprint(out, str)
+		return
+	}
+
+	// Standard output is shared by every VM in the process, so only write whole
+	// lines to it, holding on to any partial line until it's finished (or the
+	// script is), so that concurrent VMs can't interleave their output mid-line.
+	v.stdoutBuf = append(v.stdoutBuf, str...)
+	if i := bytes.LastIndexByte(v.stdoutBuf, '\n'); i >= 0 {
+		writeStdout(v.stdoutBuf[:i+1])
+		v.stdoutBuf = append(v.stdoutBuf[:0], v.stdoutBuf[i+1:]...)
+	}
+}
+
+// limitOutput truncates output to fit within the limit set by SetOutputLimit, if any,
+// flagging the virtual machine once it's been exceeded.
+func (vm *VM) limitOutput(str string) string {
+	if vm.outputLimit <= 0 {
+		return str
+	}
+	if remaining := vm.outputLimit - vm.outputCount; int64(len(str)) > remaining {
+		// The limit may have been lowered below what's already been written, and
+		// the output shouldn't end partway through a character.
+		cut := 0
+		if remaining > 0 {
+			cut = int(remaining)
+		}
+		for cut > 0 && !utf8.RuneStart(str[cut]) {
+			cut--
+		}
+		str = str[:cut]
+		vm.outputExceeded = true
+	}
+	vm.outputCount += int64(len(str))
+	return str
+}
+
+// stdoutGuard serializes writes to standard output across virtual machines.
+var stdoutGuard sync.Mutex
+
+// writeStdout writes p to standard output in one piece.
+func writeStdout(p []byte) {
+	stdoutGuard.Lock()
+	defer stdoutGuard.Unlock()
+	os.Stdout.Write(p)
+}
+
+// flushStdout writes out any partial line of standard output being held back.
+func (vm *VM) flushStdout() {
+	if len(vm.stdoutBuf) > 0 {
+		writeStdout(vm.stdoutBuf)
+		vm.stdoutBuf = vm.stdoutBuf[:0]
 	}
-	fmt.Fprint(out, C.GoString(text))
 }
 
 //helper
@@ -360,44 +3742,147 @@ func readModule(dir string, name string) (string, error) {
 	return "", fmt.Errorf("module not found: %s", name)
 }
 
+// readModuleFS is like readModule, but reads from a filesystem.
+func readModuleFS(fsys fs.FS, name string) (string, error) {
+	for _, filename := range []string{
+		name + ".wren",
+		path.Join(name, "module.wren"),
+	} {
+		if data, err := fs.ReadFile(fsys, filename); err == nil {
+			return string(data), nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("load module: error reading file %s: %w", filename, err)
+		}
+	}
+	return "", fmt.Errorf("module not found: %s", name)
+}
+
+// moduleResult wraps module source for returning to Wren, which hands it back to
+// freeModuleSource once it's done compiling.
+func moduleResult(source string) C.WrenLoadModuleResult {
+	return C.WrenLoadModuleResult{
+		source:     C.CString(source),
+		onComplete: C.WrenLoadModuleCompleteFn(C.freeModuleSource),
+	}
+}
+
+// ErrImportDepth is returned when a script's imports are nested more deeply than the
+// limit set by SetMaxImportDepth.
+var ErrImportDepth = errors.New("import depth limit exceeded")
+
+// SetMaxImportDepth limits how deeply imports may be nested, as a safeguard for servers
+// loading module trees supplied by users. Modules imported by the main module are at
+// depth 1, the modules they import at depth 2, and so on. An import that goes past the
+// limit fails, aborting the importing fiber, and the Interpret or Call returns an error
+// wrapping ErrImportDepth that lists the chain of imports, if the script doesn't catch
+// it. A limit of zero or less removes the limit.
+func (vm *VM) SetMaxImportDepth(n int) {
+	vm.maxImportDepth = n
+}
+
+// importTooDeep reports the chain of imports, innermost first, as having gone past the
+// import depth limit, and returns null for resolveModule to fail the import with.
+func (vm *VM) importTooDeep(chain []string) *C.char {
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	vm.importErr = fmt.Errorf("%w: %s", ErrImportDepth, strings.Join(chain, " -> "))
+	return vm.failImport(vm.importErr.Error())
+}
+
+// failImport returns null for resolveModule to fail an import with, arranging for the
+// error Wren reports about it to be replaced with the given message, since Wren's own
+// only says that the module couldn't be resolved.
+func (vm *VM) failImport(msg string) *C.char {
+	vm.resolveErr = msg
+	return nil
+}
+
+//export resolveModule
+func resolveModule(vm *C.WrenVM, c_importer, c_name *C.char) *C.char {
+	var (
+		v        = lookupVM(vm)
+		importer = C.GoString(c_importer)
+		name     = C.GoString(c_name)
+	)
+
+	// Walk back up the chain of imports that led here. If the module being
+	// imported is part of it, then it's still being loaded and this is a cycle.
+	chain := []string{name, importer}
+	for module := importer; module != name; {
+		parent, ok := v.importers[module]
+		if !ok {
+			if v.maxImportDepth > 0 && len(chain)-1 > v.maxImportDepth {
+				return v.importTooDeep(chain)
+			}
+			if _, loading := v.importers[name]; !loading {
+				v.importers[name] = importer
+			}
+			return c_name
+		}
+		chain = append(chain, parent)
+		module = parent
+	}
+
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	// Returning null makes Wren abort the importing fiber.
+	return v.failImport("circular import: " + strings.Join(chain, " -> "))
+}
+
 //export loadModule
-func loadModule(vm *C.WrenVM, name *C.char) *C.char {
+func loadModule(vm *C.WrenVM, name *C.char) C.WrenLoadModuleResult {
 	var module string = C.GoString(name)
 
+	// Sandboxed scripts can't import anything; returning no source at all makes
+	// Wren fail the import.
+	if v := lookupVM(vm); v != nil && v.sandboxed {
+		return C.WrenLoadModuleResult{}
+	}
+
 	// Ensure module does not have undesired characters
 	// that can pose thread to remote-code-inclusions
 	if strings.Contains(module, "..") {
 		// early return with no-code
-		return C.CString("")
+		return moduleResult("")
 	}
 
 	var source string
 
+	// Prefer the module filesystem, if there is one
+	if v := lookupVM(vm); v != nil && v.moduleFS != nil {
+		if fdata, e := readModuleFS(v.moduleFS, module); e == nil {
+			return moduleResult(v.wrapImported(module, v.keepSource(module, v.transformSource(module, fdata))))
+		}
+	}
+
 	// Proceed to load from the configured modules directory only
-	var jvalPtr unsafe.Pointer = C.wrenGetUserData(vm)
+	var jvalPtr *C.char = (*C.goWrenData)(C.wrenGetUserData(vm)).json
 	if jvalPtr != nil {
 		userData := make(map[string]interface{})
-		jval := C.GoString((*C.char)(jvalPtr))
+		jval := C.GoString(jvalPtr)
 		if e := json.Unmarshal([]byte(jval), &userData); e == nil {
 			if modulesDir, ok := userData["MODULES_DIR"]; ok {
 				if fdata, e := readModule(modulesDir.(string), module); e == nil {
-					source = string(fdata)
+					v := lookupVM(vm)
+					source = v.wrapImported(module, v.keepSource(module, v.transformSource(module, string(fdata))))
 				} // TOOD: log error or return to Wren VM
 			}
 		}
 	}
 
-	return C.CString(source)
+	return moduleResult(source)
 }
 
 //export bindMethod
-func bindMethod(vm *C.WrenVM, c_module, c_className *C.char, c_isStatic C.bool, c_signature *C.char) unsafe.Pointer {
-	module := C.GoString(c_module)
-	if module != "main" {
-		return unsafe.Pointer(nil)
-	}
+func bindMethod(vm *C.WrenVM, c_module, c_className *C.char, c_isStatic C.bool, c_signature *C.char) (ptr unsafe.Pointer) {
+	v := lookupVM(vm)
+	// Leaving the method unbound makes calling it a runtime error.
+	defer v.recoverCallback("binding a foreign method")
 
 	var (
+		module    = C.GoString(c_module)
 		className = C.GoString(c_className)
 		isStatic  = bool(c_isStatic)
 		signature = C.GoString(c_signature)
@@ -411,75 +3896,267 @@ func bindMethod(vm *C.WrenVM, c_module, c_className *C.char, c_isStatic C.bool,
 	fullName.WriteString(".")
 	fullName.WriteString(signature)
 
-	if f, ok := vmMap[vm].methods[fullName.String()]; ok {
+	if isInternalModule(module) {
+		return v.internal[fullName.String()]
+	}
+
+	if f, ok := v.methods[fullName.String()]; ok {
+		v.bound[f] = true
 		return f
 	}
+	if v.debug {
+		fmt.Fprintf(errorOutput(), "debug: no foreign method registered for %q; registered methods: [%s]\n", fullName.String(), strings.Join(v.RegisteredMethods(), ", "))
+	}
 	return unsafe.Pointer(nil)
 }
 
 //export bindClass
-func bindClass(vm *C.WrenVM, c_module, c_className *C.char) C.WrenForeignClassMethods {
-	module := C.GoString(c_module)
-	if module != "main" {
-		panic("tried to bind foreign class from non-main module")
-	}
+func bindClass(vm *C.WrenVM, c_module, c_className *C.char) (methods C.WrenForeignClassMethods) {
+	v := lookupVM(vm)
+	// Wren has no way to refuse a foreign class, so until it's found, give it one
+	// that can't be constructed.
+	methods.allocate = C.WrenForeignMethodFn(C.allocateUnregistered)
+	defer v.recoverCallback("binding a foreign class")
 
+	module := C.GoString(c_module)
 	className := C.GoString(c_className)
-	if c, ok := vmMap[vm].classes[className]; ok {
-		// Might be a good idea to support finalizers, but since this is Go,
-		// I don't think they're actually necessary.
+	if module == gcModule {
 		return C.WrenForeignClassMethods{
+			allocate: C.WrenForeignMethodFn(C.goWrenSentinelAllocate),
+			finalize: C.WrenFinalizerFn(C.goWrenSentinelFinalize),
+		}
+	}
+	if isInternalModule(module) {
+		if c, ok := v.internal[className]; ok {
+			return C.WrenForeignClassMethods{
+				allocate: C.WrenForeignMethodFn(c),
+				finalize: C.WrenFinalizerFn(C.finalizeRef),
+			}
+		}
+		return methods
+	}
+
+	if c, ok := v.classes[className]; ok {
+		v.bound[c] = true
+		v.classModules[className] = module
+		// Values copied into Wren's memory don't need finalizing, but references
+		// need to be unpinned once Wren is done with them.
+		methods = C.WrenForeignClassMethods{
 			allocate: C.WrenForeignMethodFn(c),
 			finalize: nil,
 		}
+		if v.refClasses[className] {
+			methods.finalize = C.WrenFinalizerFn(C.finalizeRef)
+		}
+		return methods
+	}
+
+	if v.debug {
+		fmt.Fprintf(errorOutput(), "debug: no foreign class registered for %q; registered classes: [%s]\n", className, strings.Join(v.RegisteredClasses(), ", "))
 	}
+	return methods
+}
+
+//export allocateUnregistered
+func allocateUnregistered(vm *C.WrenVM) {
+	abortFiber(vm, "foreign class is not registered")
+}
+
+// recoverFunc is deferred by each of the functions in cglue.go, like abortOnPanic is by
+// the foreign methods and allocators they call, so that a panic in one that doesn't
+// recover by itself still can't unwind through Wren's C stack.
+func recoverFunc(vm unsafe.Pointer) {
+	if r := recover(); r != nil {
+		abortFiber((*C.WrenVM)(vm), withStack((*C.WrenVM)(vm), fmt.Errorf("%v", r)).Error())
+	}
+}
 
-	panic(fmt.Sprintf("foreign class %s not found", className))
+// missingFunc is called in place of a foreign function whose slot in the registration
+// pool is empty, which happens if Wren calls one it bound before the slot was freed.
+func missingFunc(vm unsafe.Pointer, i int) {
+	abortFiber((*C.WrenVM)(vm), fmt.Sprintf("foreign function %d is not registered", i))
 }
 
 //export writeErr
 func writeErr(vm *C.WrenVM, errorType C.WrenErrorType, module *C.char, line C.int, message *C.char) {
-	out := errWriter
-	if out == nil {
-		out = os.Stderr
+	v := lookupVM(vm)
+	defer v.recoverCallback("writing an error")
+	if errorType == C.WREN_ERROR_RUNTIME && v.resolveErr != "" {
+		// This is Wren reporting an import that resolveModule failed on purpose.
+		c_message := C.CString(v.resolveErr)
+		defer C.free(unsafe.Pointer(c_message))
+		message, v.resolveErr = c_message, ""
+	}
+	moduleName := C.GoString(module)
+	if errorType != C.WREN_ERROR_STACK_TRACE {
+		v.skipWrapper = false
+	} else if moduleName == foreignModule || v.skipWrapper {
+		// Leave out GoForeign, along with the method wrapForeign declared that called
+		// it, which stands in for a foreign method that would have had no frame.
+		v.skipWrapper = moduleName == foreignModule
+		return
+	}
+	if v.preluded[moduleName] && line > 1 {
+		line-- // for the line wrapImported added
 	}
+	if v.inserted > 0 && moduleName == v.sourceModule && int(line) > v.insertedAt {
+		// Report lines against the source as it was given, before it was rewritten.
+		line -= C.int(v.inserted)
+		if int(line) < v.insertedAt {
+			line = C.int(v.insertedAt)
+		}
+	}
+	if moduleName == "main" && v.displayName != "" {
+		moduleName = v.displayName
+	}
+	if errorType == C.WREN_ERROR_COMPILE {
+		v.recordCompileError(C.GoString(module), moduleName, int(line), C.GoString(message))
+	} else {
+		v.recordRuntimeError(errorType, C.GoString(module), moduleName, int(line), C.GoString(message))
+	}
+
+	if fn := v.errFunc; fn != nil {
+		var errType string
+		switch errorType {
+		case C.WREN_ERROR_COMPILE:
+			errType = ErrorTypeCompile
+		case C.WREN_ERROR_RUNTIME:
+			errType = ErrorTypeRuntime
+		case C.WREN_ERROR_STACK_TRACE:
+			errType = ErrorTypeStackTrace
+		default:
+			panic("impossible error type")
+		}
+		fn(errType, moduleName, int(line), C.GoString(message))
+		return
+	}
+
+	out := errorOutput()
 
 	switch errorType {
 	case C.WREN_ERROR_COMPILE:
-		fmt.Fprintf(out, "compilation error: %s:%d: %s\n", C.GoString(module), int(line), C.GoString(message))
+		fmt.Fprintf(out, "compilation error: %s:%d: %s\n", moduleName, int(line), C.GoString(message))
 
 	case C.WREN_ERROR_RUNTIME:
 		fmt.Fprintf(out, "runtime error: %s", C.GoString(message))
 
 	case C.WREN_ERROR_STACK_TRACE:
-		fmt.Fprintf(out, "\t%s:%d: %s\n", C.GoString(module), int(line), C.GoString(message))
+		fmt.Fprintf(out, "\t%s:%d: %s\n", moduleName, int(line), C.GoString(message))
 
 	default:
 		panic("impossible error type")
 	}
 }
 
+// errorOutput returns the writer to be used for error output.
+func errorOutput() io.Writer {
+	if errWriter == nil {
+		return os.Stderr
+	}
+	return errWriter
+}
+
 func interpretResultToErr(result C.WrenInterpretResult) error {
 	switch result {
 	case C.WREN_RESULT_SUCCESS:
 		return nil
 
 	case C.WREN_RESULT_COMPILE_ERROR:
-		return errors.New("compilation error")
+		return ErrCompilation
 
 	case C.WREN_RESULT_RUNTIME_ERROR:
-		return errors.New("runtime error")
+		return ErrRuntime
 
 	default:
 		panic("unreachable")
 	}
 }
 
+var (
+	valueType        = reflect.TypeOf((*Value)(nil))
+	bigIntType       = reflect.TypeOf((*big.Int)(nil))
+	bigFloatType     = reflect.TypeOf((*big.Float)(nil))
+	rangeType        = reflect.TypeOf(Range{})
+	intsType         = reflect.TypeOf([]int(nil))
+	float64Type      = reflect.TypeOf(float64(0))
+	float64SliceType = reflect.TypeOf([]float64(nil))
+	stringerType     = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+// UnsupportedTypeError is the error produced when a Go value can't be converted
+// to a Wren value.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Type == nil {
+		return "can't convert invalid value to a Wren value"
+	}
+	return fmt.Sprintf("can't convert value of type %s to a Wren value", e.Type)
+}
+
+// saveToSlot saves a Go value into the given slot.
+//
+// Wren numbers can't hold arbitrary-precision values, so *big.Int and *big.Float
+// values are saved as strings of their decimal representation. getFromSlot
+// accepts such strings (as well as numbers) for *big.Int and *big.Float
+// parameters.
 func saveToSlot(vm *C.WrenVM, slot int, v reflect.Value) {
 	c_slot := C.int(slot)
+	if v.IsValid() {
+		switch v.Type() {
+		case bigIntType, bigFloatType:
+			var str string
+			if v.IsNil() {
+				C.wrenSetSlotNull(vm, c_slot)
+				return
+			}
+			if n, ok := v.Interface().(*big.Int); ok {
+				str = n.String()
+			} else {
+				str = v.Interface().(*big.Float).Text('g', -1)
+			}
+			saveToSlot(vm, slot, reflect.ValueOf(str))
+			return
+		}
+	}
+	if v.IsValid() && v.Type() == valueType {
+		// Values already live in Wren, so just hand back the handle.
+		value := v.Interface().(*Value)
+		if value == nil {
+			C.wrenSetSlotNull(vm, c_slot)
+			return
+		}
+		if value.value == nil {
+			panic(ErrReleased)
+		}
+		if owner := value.live(); owner == nil {
+			panic(ErrClosed)
+		} else if owner != lookupVM(vm) {
+			panic("can't pass a value between virtual machines")
+		}
+		C.wrenSetSlotHandle(vm, c_slot, value.value)
+		return
+	}
+	if v.IsValid() {
+		if className, ok := lookupVM(vm).foreignTypes[v.Type()]; ok {
+			saveForeign(vm, slot, className, v)
+			return
+		}
+	}
+	if v.IsValid() && v.Kind() != reflect.Interface && lookupVM(vm).useStringers && v.Type().Implements(stringerType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			C.wrenSetSlotNull(vm, c_slot)
+			return
+		}
+		saveToSlot(vm, slot, reflect.ValueOf(v.Interface().(fmt.Stringer).String()))
+		return
+	}
+
 	switch v.Kind() {
 	case reflect.Bool:
-		c_value := C.bool(v.Interface().(bool))
+		c_value := C.bool(v.Bool())
 		C.wrenSetSlotBool(vm, c_slot, c_value)
 
 	case reflect.Float32, reflect.Float64:
@@ -495,47 +4172,539 @@ func saveToSlot(vm *C.WrenVM, slot int, v reflect.Value) {
 		C.wrenSetSlotDouble(vm, c_slot, c_value)
 
 	case reflect.String:
-		c_value := C.CString(v.Interface().(string))
+		// Strings are passed with their length, so they may contain NUL bytes.
+		str := v.String()
+		c_value := C.CString(str)
 		defer C.free(unsafe.Pointer(c_value))
-		C.wrenSetSlotString(vm, c_slot, c_value)
+		C.wrenSetSlotBytes(vm, c_slot, c_value, C.size_t(len(str)))
+
+	case reflect.Ptr, reflect.Interface:
+		// Save whatever is being pointed to, or null if there's nothing there.
+		if v.IsNil() {
+			C.wrenSetSlotNull(vm, c_slot)
+			return
+		}
+		saveToSlot(vm, slot, v.Elem())
+
+	case reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			saveListToSlot(vm, slot, v)
+			return
+		}
+		// Fixed-size byte arrays, such as hashes, are saved as strings of their bytes.
+		b := make([]byte, v.Len())
+		for i := range b {
+			b[i] = byte(v.Index(i).Uint())
+		}
+		c_value := C.CBytes(b)
+		defer C.free(c_value)
+		C.wrenSetSlotBytes(vm, c_slot, (*C.char)(c_value), C.size_t(len(b)))
+
+	case reflect.Slice:
+		saveListToSlot(vm, slot, v)
+
+	case reflect.Map:
+		// Maps are saved as maps, provided their keys become values Wren can use
+		// as keys.
+		if v.IsNil() {
+			C.wrenSetSlotNull(vm, c_slot)
+			return
+		}
+		C.wrenSetSlotNewMap(vm, c_slot)
+		scratch := scratchSlots(vm, 2)
+		iter := v.MapRange()
+		for iter.Next() {
+			saveToSlot(vm, scratch, iter.Key())
+			switch C.wrenGetSlotType(vm, C.int(scratch)) {
+			case C.WREN_TYPE_BOOL, C.WREN_TYPE_NUM, C.WREN_TYPE_STRING, C.WREN_TYPE_NULL:
+			default:
+				panic(fmt.Sprintf("can't use %T as a Wren map key", iter.Key().Interface()))
+			}
+			saveToSlot(vm, scratch+1, iter.Value())
+			C.wrenSetMapValue(vm, c_slot, C.int(scratch), C.int(scratch+1))
+		}
+
+	case reflect.Struct:
+		// Structs are saved as a map of their exported fields.
+		useTags := lookupVM(vm).jsonTags
+		C.wrenSetSlotNewMap(vm, c_slot)
+		scratch := scratchSlots(vm, 2)
+		for i := 0; i < v.NumField(); i++ {
+			key, ok := fieldKey(v.Type().Field(i), useTags)
+			if !ok {
+				continue
+			}
+			saveToSlot(vm, scratch, reflect.ValueOf(key))
+			saveToSlot(vm, scratch+1, v.Field(i))
+			C.wrenSetMapValue(vm, c_slot, C.int(scratch), C.int(scratch+1))
+		}
 
 	default:
-		panic(fmt.Sprintf("don't know how to save this to a slot: %s", v.Type().Name()))
+		if !v.IsValid() {
+			panic(&UnsupportedTypeError{})
+		}
+		panic(&UnsupportedTypeError{Type: v.Type()})
+	}
+}
+
+// saveListToSlot saves a slice or array as a list of its elements.
+func saveListToSlot(vm *C.WrenVM, slot int, v reflect.Value) {
+	if v.Kind() == reflect.Slice && v.Type().Elem() == float64Type {
+		// Common enough for numeric data, and long enough, to be worth a fast path that
+		// skips reflection, passing every element through the same scratch slot;
+		// BenchmarkFloatSlice compares it with saving each element generically.
+		floats := v.Convert(float64SliceType).Interface().([]float64)
+		C.wrenSetSlotNewList(vm, C.int(slot))
+		scratch := C.int(scratchSlots(vm, 1))
+		for _, f := range floats {
+			C.wrenSetSlotDouble(vm, scratch, C.double(f))
+			C.wrenInsertInList(vm, C.int(slot), -1, scratch)
+		}
+		return
+	}
+
+	C.wrenSetSlotNewList(vm, C.int(slot))
+	scratch := scratchSlots(vm, 1)
+	for i := 0; i < v.Len(); i++ {
+		saveToSlot(vm, scratch, v.Index(i))
+		C.wrenInsertInList(vm, C.int(slot), -1, C.int(scratch))
+	}
+}
+
+// saveForeign saves a value as a new instance of the foreign class registered for
+// its type.
+func saveForeign(vm *C.WrenVM, slot int, className string, v reflect.Value) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		C.wrenSetSlotNull(vm, C.int(slot))
+		return
+	}
+
+	// The class is looked up in the module that declared it, or in the main module
+	// if it hasn't been declared yet, which fails below.
+	wvm := lookupVM(vm)
+	module := wvm.classModules[className]
+	if module == "" {
+		module = "main"
+	}
+	c_module := C.CString(module)
+	defer C.free(unsafe.Pointer(c_module))
+	c_className := C.CString(className)
+	defer C.free(unsafe.Pointer(c_className))
+	if !C.wrenHasModule(vm, c_module) || !C.wrenHasVariable(vm, c_module, c_className) {
+		panic(fmt.Sprintf("foreign class %s has not been defined", className))
+	}
+
+	scratch := scratchSlots(vm, 1)
+	C.wrenGetVariable(vm, c_module, c_className, C.int(scratch))
+	if wvm.refClasses[className] {
+		newForeignRef(vm, slot, scratch, v.Interface())
+	} else {
+		newForeign(vm, slot, scratch, v.Interface())
+	}
+}
+
+// scratchSlots reserves n slots above those currently in use, for holding
+// intermediate values such as the elements of a list, and returns the first.
+func scratchSlots(vm *C.WrenVM, n int) int {
+	first := int(C.wrenGetSlotCount(vm))
+	C.wrenEnsureSlots(vm, C.int(first+n))
+	return first
+}
+
+// fieldKey returns the Wren map key used for a struct field, and false if the field
+// shouldn't appear in the map at all. If useTags is true, a field's json tag takes
+// precedence over its name, and fields tagged "-" are skipped.
+func fieldKey(f reflect.StructField, useTags bool) (string, bool) {
+	if f.PkgPath != "" {
+		// unexported
+		return "", false
+	}
+	if useTags {
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			return "", false
+		}
+		if name := strings.Split(tag, ",")[0]; name != "" {
+			return name, true
+		}
+	}
+	return f.Name, true
+}
+
+// FormatNumber formats a number the same way Wren does when converting it to a
+// string, such as when printing it, so that Go code can produce output matching a
+// script's. Integral values have no decimal point, so 5.0 is formatted as "5".
+func FormatNumber(f float64) string {
+	// Wren handles these itself rather than relying on libc, so do the same.
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "infinity"
+	case math.IsInf(f, -1):
+		return "-infinity"
+	}
+	return fmt.Sprintf("%.14g", f)
+}
+
+// maxExactInteger is the largest magnitude at which every integer can still be
+// represented exactly by a float64, Wren's only number type.
+const maxExactInteger = 1 << 53
+
+// convertNumber converts a Wren number to the Go type t. Numbers beyond
+// maxExactInteger may already have been rounded by Wren, so rather than
+// silently handing a possibly-wrong value to an integer parameter, this
+// panics, as it does for numbers that don't fit in the target type, NaN and
+// infinities, and fractional numbers that would otherwise be truncated.
+func convertNumber(n float64, t reflect.Type) reflect.Value {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			panic(fmt.Sprintf("number %s is not finite and can't be converted to %s", FormatNumber(n), t))
+		}
+		if n != math.Trunc(n) {
+			panic(fmt.Sprintf("number %v has a fractional part and can't be converted to %s", n, t))
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n > maxExactInteger || n < -maxExactInteger {
+			panic(fmt.Sprintf("number %v exceeds the precision of a Wren number and can't be converted exactly to %s", n, t))
+		}
+		if reflect.Zero(t).OverflowInt(int64(n)) {
+			panic(fmt.Sprintf("number %v overflows %s", n, t))
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n > maxExactInteger {
+			panic(fmt.Sprintf("number %v exceeds the precision of a Wren number and can't be converted exactly to %s", n, t))
+		}
+		if n < 0 || reflect.Zero(t).OverflowUint(uint64(n)) {
+			panic(fmt.Sprintf("number %v overflows %s", n, t))
+		}
+	}
+	switch t {
+	case bigIntType:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			panic(fmt.Sprintf("number %s is not finite and can't be converted to %s", FormatNumber(n), t))
+		}
+		if n != math.Trunc(n) {
+			panic(fmt.Sprintf("number %v has a fractional part and can't be converted to %s", n, t))
+		}
+		i, _ := big.NewFloat(n).Int(nil)
+		return reflect.ValueOf(i)
+
+	case bigFloatType:
+		return reflect.ValueOf(big.NewFloat(n))
+	}
+	return reflect.ValueOf(n).Convert(t)
+}
+
+// structFromMap fills in a struct of the given type from the map in the given slot,
+// the reverse of how saveToSlot saves structs. Fields without a matching key are left
+// as their zero value, and keys without a matching field are ignored, unless the
+// virtual machine disallows them. If shape isn't noShape, it's the slot holding the
+// map's shape, as passed along by GoForeign.invoke_.
+func structFromMap(vm *C.WrenVM, slot, shape int, t reflect.Type) reflect.Value {
+	var (
+		result  = reflect.New(t).Elem()
+		useTags = lookupVM(vm).jsonTags
+		strict  = lookupVM(vm).strictFields
+		names   []string
+		fields  = make(map[string]int)
+	)
+	for i := 0; i < t.NumField(); i++ {
+		if key, ok := fieldKey(t.Field(i), useTags); ok {
+			names = append(names, key)
+			fields[key] = i
+		}
+	}
+	setField := func(i, value, valueShape int) {
+		var hint *reflect.Type
+		if fieldType := t.Field(i).Type; fieldType.Kind() != reflect.Interface {
+			hint = &fieldType
+		}
+		if v := getFromSlot(vm, value, valueShape, hint); v.IsValid() {
+			result.Field(i).Set(v)
+		}
+	}
+
+	if shape != noShape {
+		// With the map's keys at hand, each of them can be matched to a field.
+		eachMapEntry(vm, slot, shape, func(key, value, valueShape int) {
+			k, _ := slotResult(vm, key)
+			if name, ok := k.(string); ok {
+				if i, ok := fields[name]; ok {
+					setField(i, value, valueShape)
+					return
+				}
+			}
+			if strict {
+				panic(fmt.Sprintf("unknown field %v for %s; expected only %s", k, t, strings.Join(names, ", ")))
+			}
+		})
+		return result
+	}
+
+	var (
+		matched int
+		scratch = scratchSlots(vm, 2)
+	)
+	for _, key := range names {
+		saveToSlot(vm, scratch, reflect.ValueOf(key))
+		if !C.wrenGetMapContainsKey(vm, C.int(slot), C.int(scratch)) {
+			continue
+		}
+		matched++
+		C.wrenGetMapValue(vm, C.int(slot), C.int(scratch), C.int(scratch+1))
+		setField(fields[key], scratch+1, noShape)
+	}
+
+	// Without its shape, any key that isn't a field shows up only as the map having
+	// more entries than the fields it matched.
+	if unknown := int(C.wrenGetMapCount(vm, C.int(slot))) - matched; unknown > 0 && strict {
+		panic(fmt.Sprintf("map has %d unknown field(s) for %s; expected only %s", unknown, t, strings.Join(names, ", ")))
 	}
+	return result
 }
 
-func getFromSlot(vm *C.WrenVM, slot int, in *reflect.Type) reflect.Value {
+// eachMapEntry calls f with the slots holding each key of the map in the given slot,
+// the value it maps to, and the shape of that value, or noShape if it has none. The
+// keys are taken from the map's shape, in the given slot, which is a list of the keys
+// followed by a list of the shapes of their values, or null if none have any.
+func eachMapEntry(vm *C.WrenVM, slot, shape int, f func(key, value, valueShape int)) {
+	scratch := scratchSlots(vm, 5)
+	C.wrenGetListElement(vm, C.int(shape), 0, C.int(scratch))
+	C.wrenGetListElement(vm, C.int(shape), 1, C.int(scratch+1))
+	shaped := C.wrenGetSlotType(vm, C.int(scratch+1)) != C.WREN_TYPE_NULL
+	count := int(C.wrenGetListCount(vm, C.int(scratch)))
+	for i := 0; i < count; i++ {
+		C.wrenGetListElement(vm, C.int(scratch), C.int(i), C.int(scratch+2))
+		C.wrenGetMapValue(vm, C.int(slot), C.int(scratch+2), C.int(scratch+3))
+		valueShape := noShape
+		if shaped {
+			C.wrenGetListElement(vm, C.int(scratch+1), C.int(i), C.int(scratch+4))
+			valueShape = scratch + 4
+		}
+		f(scratch+2, scratch+3, valueShape)
+	}
+}
+
+// mapFromSlot converts the map in the given slot to a Go map of the given type, with
+// its keys taken from its shape, in the given slot.
+func mapFromSlot(vm *C.WrenVM, slot, shape int, mapType reflect.Type) reflect.Value {
+	var (
+		keyType, elemType = mapType.Key(), mapType.Elem()
+		keyHint, elemHint *reflect.Type
+		result            = reflect.MakeMapWithSize(mapType, int(C.wrenGetMapCount(vm, C.int(slot))))
+	)
+	if keyType.Kind() != reflect.Interface {
+		keyHint = &keyType
+	}
+	if elemType.Kind() != reflect.Interface {
+		elemHint = &elemType
+	}
+	eachMapEntry(vm, slot, shape, func(key, value, valueShape int) {
+		k := getFromSlot(vm, key, noShape, keyHint)
+		if !k.IsValid() {
+			k = reflect.Zero(keyType)
+		}
+		elem := getFromSlot(vm, value, valueShape, elemHint)
+		if !elem.IsValid() {
+			elem = reflect.Zero(elemType)
+		}
+		result.SetMapIndex(k, elem)
+	})
+	return result
+}
+
+// rangeFromShape reads a range from its shape, in the given slot, which lists its from,
+// to and isInclusive.
+func rangeFromShape(vm *C.WrenVM, shape int) Range {
+	scratch := scratchSlots(vm, 1)
+	var r Range
+	C.wrenGetListElement(vm, C.int(shape), 0, C.int(scratch))
+	r.From = float64(C.wrenGetSlotDouble(vm, C.int(scratch)))
+	C.wrenGetListElement(vm, C.int(shape), 1, C.int(scratch))
+	r.To = float64(C.wrenGetSlotDouble(vm, C.int(scratch)))
+	C.wrenGetListElement(vm, C.int(shape), 2, C.int(scratch))
+	r.Inclusive = bool(C.wrenGetSlotBool(vm, C.int(scratch)))
+	return r
+}
+
+// noShape is passed in place of the slot holding a value's shape when there isn't one.
+const noShape = -1
+
+// getFromSlot converts the value in the given slot to a Go value, of the type in
+// if given. Maps can only be converted with their keys, which are taken from the
+// value's shape, in the slot shape; see GoForeign in goForeignSource.
+func getFromSlot(vm *C.WrenVM, slot, shape int, in *reflect.Type) reflect.Value {
 	c_slot := C.int(slot)
+	if shape != noShape && C.wrenGetSlotType(vm, C.int(shape)) == C.WREN_TYPE_NULL {
+		shape = noShape
+	}
+	if in != nil && *in == valueType {
+		// Anything can be kept as a handle, to be used once Wren is done running.
+		return reflect.ValueOf(newValue(vm, slot))
+	}
 	switch C.wrenGetSlotType(vm, c_slot) {
 	case C.WREN_TYPE_BOOL:
-		return reflect.ValueOf(bool(C.wrenGetSlotBool(vm, c_slot)))
+		b := bool(C.wrenGetSlotBool(vm, c_slot))
+		if in == nil {
+			return reflect.ValueOf(b)
+		}
+		// Bools can be explicitly asked for as strings or as integers, 0 or 1.
+		switch t := *in; t.Kind() {
+		case reflect.Interface:
+			return reflect.ValueOf(b)
+		case reflect.Bool:
+			return reflect.ValueOf(b).Convert(t)
+		case reflect.String:
+			return reflect.ValueOf(strconv.FormatBool(b)).Convert(t)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			var n int
+			if b {
+				n = 1
+			}
+			return reflect.ValueOf(n).Convert(t)
+		default:
+			panic(fmt.Sprintf("can't convert a bool to %s", t))
+		}
 
 	case C.WREN_TYPE_NUM:
-		n := reflect.ValueOf(float64(C.wrenGetSlotDouble(vm, c_slot)))
-		if in != nil {
-			return n.Convert(*in)
+		n := float64(C.wrenGetSlotDouble(vm, c_slot))
+		if in != nil && (*in).Kind() != reflect.Interface {
+			return convertNumber(n, *in)
+		}
+		if lookupVM(vm).preferIntegers && n == math.Trunc(n) && math.Abs(n) <= maxExactInteger {
+			return reflect.ValueOf(int64(n))
 		}
-		return n
+		return reflect.ValueOf(n)
 
 	case C.WREN_TYPE_FOREIGN:
-		if in == nil {
-			panic("can't return foreign value without type information!")
-		}
 		ptr := C.wrenGetSlotForeign(vm, c_slot)
+		if x, ok := lookupVM(vm).refs[ptr]; ok {
+			return reflect.ValueOf(x)
+		}
+		if in == nil || (*in).Kind() == reflect.Interface {
+			// Without a type to read the object as, hold on to it as a handle.
+			return reflect.ValueOf(newValue(vm, slot))
+		}
 		return reflect.NewAt((*in).Elem(), ptr)
 
 	case C.WREN_TYPE_LIST:
-		panic("not sure how to get a list value from the slot")
+		// Lists become slices, with each element converted according to the
+		// slice's element type so that foreign objects can be reconstructed.
+		sliceType := reflect.TypeOf([]interface{}(nil))
+		if in != nil && (*in).Kind() != reflect.Interface {
+			if (*in).Kind() != reflect.Slice {
+				panic(fmt.Sprintf("can't convert a list to %s", *in))
+			}
+			sliceType = *in
+		}
+		var (
+			elemType = sliceType.Elem()
+			elemHint *reflect.Type
+			count    = int(C.wrenGetListCount(vm, c_slot))
+			list     = reflect.MakeSlice(sliceType, count, count)
+			scratch  = scratchSlots(vm, 2)
+		)
+		if elemType.Kind() != reflect.Interface {
+			elemHint = &elemType
+		}
+		for i := 0; i < count; i++ {
+			C.wrenGetListElement(vm, c_slot, C.int(i), C.int(scratch))
+			elemShape := noShape
+			if shape != noShape {
+				C.wrenGetListElement(vm, C.int(shape), C.int(i), C.int(scratch+1))
+				elemShape = scratch + 1
+			}
+			if elem := getFromSlot(vm, scratch, elemShape, elemHint); elem.IsValid() {
+				list.Index(i).Set(elem)
+			}
+		}
+		return list
+
+	case C.WREN_TYPE_MAP:
+		// Maps become Go maps, with keys and values converted according to the map's
+		// types, or structs filled in from the keys matching their fields.
+		mapType := reflect.TypeOf(map[interface{}]interface{}(nil))
+		if in != nil && (*in).Kind() != reflect.Interface {
+			mapType = *in
+		}
+		switch {
+		case mapType.Kind() == reflect.Struct:
+			return structFromMap(vm, slot, shape, mapType)
+		case mapType.Kind() == reflect.Ptr && mapType.Elem().Kind() == reflect.Struct:
+			return structFromMap(vm, slot, shape, mapType.Elem()).Addr()
+		case mapType.Kind() != reflect.Map:
+			panic(fmt.Sprintf("can't convert a map to %s", mapType))
+		case shape == noShape:
+			// A foreign method can't ask Wren for a map's keys, so they have to have
+			// been passed along by the Wren method declared in its place.
+			panic(fmt.Sprintf("can't convert a map to %s without its keys; register the foreign method before declaring its class, or take a *wren.Value instead", mapType))
+		}
+		return mapFromSlot(vm, slot, shape, mapType)
 
 	case C.WREN_TYPE_NULL:
 		return reflect.Value{}
 
 	case C.WREN_TYPE_STRING:
-		str := C.GoString(C.wrenGetSlotString(vm, c_slot))
+		var length C.int
+		c_bytes := C.wrenGetSlotBytes(vm, c_slot, &length)
+		str := C.GoStringN(c_bytes, length)
+		if in != nil && (*in).Kind() == reflect.Array && (*in).Elem().Kind() == reflect.Uint8 {
+			// The reverse of how saveToSlot saves byte arrays.
+			if len(str) != (*in).Len() {
+				panic(fmt.Sprintf("can't convert a string of %d bytes to %s", len(str), *in))
+			}
+			array := reflect.New(*in).Elem()
+			for i := 0; i < len(str); i++ {
+				array.Index(i).SetUint(uint64(str[i]))
+			}
+			return array
+		}
+		if in != nil {
+			switch *in {
+			case bigIntType:
+				n, ok := new(big.Int).SetString(str, 10)
+				if !ok {
+					panic(fmt.Sprintf("can't parse %q as a *big.Int", str))
+				}
+				return reflect.ValueOf(n)
+
+			case bigFloatType:
+				n, _, err := big.ParseFloat(str, 10, 0, big.ToNearestEven)
+				if err != nil {
+					panic(fmt.Sprintf("can't parse %q as a *big.Float: %v", str, err))
+				}
+				return reflect.ValueOf(n)
+			}
+		}
 		return reflect.ValueOf(str)
 
 	case C.WREN_TYPE_UNKNOWN:
-		panic(fmt.Sprintf("received an inaccessible-from-C parameter in slot %d", slot))
+		// Objects C can't see into, such as ranges and instances of classes defined in
+		// Wren, can only be held as handles, unless they're ranges passed along with
+		// their bounds.
+		if in != nil && (*in == rangeType || *in == intsType) && shape != noShape {
+			r := rangeFromShape(vm, shape)
+			if *in == rangeType {
+				return reflect.ValueOf(r)
+			}
+			ints, err := r.Ints()
+			if err != nil {
+				panic(err.Error())
+			}
+			return reflect.ValueOf(ints)
+		}
+		if in != nil && (*in).Kind() != reflect.Interface {
+			panic(fmt.Sprintf("can't convert a Wren object to %s; use *wren.Value instead", *in))
+		}
+		return reflect.ValueOf(newValue(vm, slot))
 
 	default:
 		panic("unreachable")
@@ -1,16 +1,33 @@
 package wren_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/dradtke/go-wren"
 )
 
 func TestCompilationError(t *testing.T) {
 	vm := wren.NewVM()
+	defer vm.Close()
 	wren.SetErrorWriter(ioutil.Discard)
 
 	if err := vm.Interpret(`Don't mind me, I'm just an invalid Wren program!`); err == nil {
@@ -18,9 +35,187 @@ func TestCompilationError(t *testing.T) {
 	}
 }
 
+func TestErrorFunc(t *testing.T) {
+	type report struct {
+		errType, module string
+		line            int
+	}
+
+	var reports []report
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetErrorFunc(func(errType, module string, line int, msg string) {
+		reports = append(reports, report{errType, module, line})
+	})
+
+	if err := vm.Interpret("\n\nvar x = ("); err == nil {
+		t.Fatal("interpretation of invalid program failed to return an error")
+	}
+	if len(reports) == 0 || reports[0] != (report{wren.ErrorTypeCompile, "main", 3}) {
+		t.Errorf("unexpected compile error reports: %v", reports)
+	}
+
+	reports = nil
+	if err := vm.Interpret(`Fiber.abort("oops")`); err == nil {
+		t.Fatal("aborting the fiber failed to return an error")
+	}
+	if len(reports) < 2 || reports[0].errType != wren.ErrorTypeRuntime || reports[1] != (report{wren.ErrorTypeStackTrace, "main", 1}) {
+		t.Errorf("unexpected runtime error reports: %v", reports)
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	err := vm.Interpret("var a = 1\nvar b = a +* 2\n")
+	compileErr, ok := err.(*wren.CompileError)
+	if !ok {
+		t.Fatalf("expected a compile error, got %v", err)
+	}
+	if compileErr.Module != "main" || compileErr.Line != 2 || compileErr.Source != "var b = a +* 2" {
+		t.Errorf("unexpected compile error: %+v", compileErr)
+	}
+	if compileErr.Column != 12 {
+		t.Errorf("unexpected column %d for message %q", compileErr.Column, compileErr.Message)
+	}
+	if !strings.HasPrefix(err.Error(), "compilation error: main:2: ") {
+		t.Errorf("unexpected error message: %s", err)
+	}
+
+	// Runtime errors are unaffected.
+	if err := vm.Interpret(`Fiber.abort("oops")`); err == nil || err.Error() != "runtime error" {
+		t.Errorf("unexpected runtime error: %v", err)
+	}
+}
+
+func TestIsIncomplete(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	for source, incomplete := range map[string]bool{
+		"class Repl {\n":                   true,
+		"if (true) {\n  System.print(1)\n": true,
+		"System.print(1 +\n":               true,
+		"var list = [1, 2,\n":              true,
+		"var s = \"unfinished\n":           true,
+		"/* comment\n":                     true,
+		"var a = 1 +* 2\n":                 false,
+		"var = 3\n":                        false,
+		"Fiber.abort(\"oops\")\n":          false,
+		"var fine = 1\n":                   false,
+	} {
+		if err := vm.Interpret(source); wren.IsIncomplete(err) != incomplete {
+			t.Errorf("%q: expected IsIncomplete to be %v, got error %v", source, incomplete, err)
+		}
+	}
+}
+
+func TestValidateDir(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "sub", "bad.wren")
+	for path, contents := range map[string]string{
+		filepath.Join(dir, "good.wren"): "class Good {\n  static run() { Good.missing() }\n}\nGood.run()\n",
+		filepath.Join(dir, "notes.txt"): "not wren {",
+		bad:                             "class Bad {\n  static run( {}\n}\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := wren.ValidateDir(dir)
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	var compileErr *wren.CompileError
+	if !errors.As(errs[0], &compileErr) || compileErr.Module != bad || compileErr.Line != 2 {
+		t.Errorf("unexpected error: %v", errs[0])
+	}
+
+	if errs := wren.ValidateDir(filepath.Join(dir, "missing")); len(errs) != 1 {
+		t.Errorf("expected an error for a missing directory, got %v", errs)
+	}
+}
+
+func TestLastErrorKind(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	for source, expected := range map[string]wren.ErrorKind{
+		`var ok = 1`:          wren.ErrorKindNone,
+		`var broken = (`:      wren.ErrorKindCompile,
+		`Fiber.abort("oops")`: wren.ErrorKindRuntime,
+	} {
+		err := vm.Interpret(source)
+		if kind := vm.LastErrorKind(); kind != expected {
+			t.Errorf("%s: got kind %v, expected %v", source, kind, expected)
+		}
+		switch expected {
+		case wren.ErrorKindCompile:
+			if !errors.Is(err, wren.ErrCompilation) {
+				t.Errorf("%s: expected ErrCompilation, got %v", source, err)
+			}
+		case wren.ErrorKindRuntime:
+			if !errors.Is(err, wren.ErrRuntime) {
+				t.Errorf("%s: expected ErrRuntime, got %v", source, err)
+			}
+		}
+	}
+
+	if _, err := vm.Variable("ok").Call("missing()"); !errors.Is(err, wren.ErrRuntime) || vm.LastErrorKind() != wren.ErrorKindRuntime {
+		t.Errorf("expected a failed call to be a runtime error, got %v", err)
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	var modules []string
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetErrorFunc(func(errType, module string, line int, msg string) {
+		modules = append(modules, fmt.Sprintf("%s:%d", module, line))
+	})
+
+	dir, err := ioutil.TempDir("", "wren")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.wren")
+	if err := ioutil.WriteFile(filename, []byte("\nvar x = ("), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.InterpretFile(filename); err == nil {
+		t.Fatal("expected a compile error")
+	}
+	if len(modules) == 0 || modules[0] != filename+":2" {
+		t.Errorf("unexpected error locations: %v", modules)
+	}
+
+	modules = nil
+	vm.SetDisplayName("repl")
+	if err := vm.Interpret(`Fiber.abort("oops")`); err == nil {
+		t.Fatal("expected a runtime error")
+	}
+	if len(modules) < 2 || modules[1] != "repl:1" {
+		t.Errorf("unexpected error locations: %v", modules)
+	}
+}
+
 func TestOutputRedirect(t *testing.T) {
 	var buf bytes.Buffer
 	vm := wren.NewVM()
+	defer vm.Close()
 	vm.SetOutputWriter(&buf)
 
 	if err := vm.Interpret(`System.print("Hello, Wren!")`); err != nil {
@@ -32,113 +227,4750 @@ func TestOutputRedirect(t *testing.T) {
 	}
 }
 
-func TestForeignMethod(t *testing.T) {
+func TestConcurrentStdout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	output := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		output <- string(data)
+	}()
+
+	var wg sync.WaitGroup
+	for _, word := range []string{"alpha", "beta", "gamma", "delta"} {
+		wg.Add(1)
+		go func(word string) {
+			defer wg.Done()
+			vm := wren.NewVM()
+			defer vm.Close()
+			if err := vm.Interpret(`
+				for (i in 1..200) {
+					System.write("` + word + `")
+					System.print(" ` + word + `")
+				}
+			`); err != nil {
+				t.Error(err)
+			}
+		}(word)
+	}
+	wg.Wait()
+	w.Close()
+
+	lines := strings.Split(strings.TrimSuffix(<-output, "\n"), "\n")
+	if len(lines) != 800 {
+		t.Errorf("expected 800 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if words := strings.Fields(line); len(words) != 2 || words[0] != words[1] {
+			t.Errorf("garbled line: %q", line)
+			break
+		}
+	}
+}
+
+func TestAddOutputWriter(t *testing.T) {
+	var primary, copy1, copy2 bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&primary)
+	vm.AddOutputWriter(&copy1)
+	vm.AddOutputWriter(&copy2)
+
+	if err := vm.Interpret(`System.print("tee")`); err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range []*bytes.Buffer{&primary, &copy1, &copy2} {
+		if buf.String() != "tee\n" {
+			t.Errorf("unexpected output: %q", buf.String())
+		}
+	}
+
+	// Setting the writer again drops the copies.
+	vm.SetOutputWriter(&primary)
+	if err := vm.Interpret(`System.print("again")`); err != nil {
+		t.Fatal(err)
+	}
+	if primary.String() != "tee\nagain\n" || copy1.String() != "tee\n" {
+		t.Errorf("unexpected output: %q, %q", primary.String(), copy1.String())
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
 	var buf bytes.Buffer
 	vm := wren.NewVM()
+	defer vm.Close()
 	vm.SetOutputWriter(&buf)
+	vm.SetOutputLimit(10)
 
-	vm.RegisterForeignMethod("static GoMath.add(_,_)", func(a, b int) int {
-		return a + b
-	})
+	if err := vm.Interpret(`System.print("short")`); err != nil {
+		t.Fatal(err)
+	}
 
-	if err := vm.Interpret(`
-		class GoMath {
-			foreign static add(x, y)
+	buf.Reset()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	err := vm.InterpretContext(context.Background(), `
+		class Go {
+			foreign static tick()
 		}
+		while (true) {
+			Go.tick()
+			System.print("spam")
+		}
+	`)
+	if err != wren.ErrOutputLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if buf.String() != "spam\nspam\nsp" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
 
-		System.write(GoMath.add(2, 3))
-	`); err != nil {
-		t.Log(err.Error())
-		t.FailNow()
+	// Characters aren't cut in half.
+	buf.Reset()
+	vm.SetOutputLimit(2)
+	if err := vm.Interpret(`System.write("héllo")`); err != wren.ErrOutputLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if buf.String() != "h" {
+		t.Errorf("unexpected output: %q", buf.String())
 	}
 
-	if buf.String() != "5" {
+	// Lowering the limit below what's already been printed stops any more output.
+	buf.Reset()
+	vm.SetOutputLimit(100)
+	if err := vm.RegisterForeignMethod("static Limit.lower()", func(vm *wren.VM) {
+		vm.SetOutputLimit(3)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err = vm.Interpret(`
+		class Limit {
+			foreign static lower()
+		}
+		System.write("12345")
+		Limit.lower()
+		System.write("678")
+	`)
+	if err != wren.ErrOutputLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if buf.String() != "12345" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestOutputFunc(t *testing.T) {
+	var buf bytes.Buffer
+	var got []string
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	vm.SetOutputFunc(func(s string) {
+		got = append(got, s)
+	})
+
+	if err := vm.Interpret(`System.write("a")
+		System.write("b")`); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[a b]" {
+		t.Errorf("unexpected output: %v", got)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("output writer was used: %s", buf.String())
+	}
+
+	vm.SetOutputFunc(nil)
+	if err := vm.Interpret(`System.write("c")`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "c" {
 		t.Errorf("unexpected output: %s", buf.String())
 	}
+}
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Error("GoMath.add(_,_) call succeeded with invalid parameters")
+func TestInterpretValue(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(ioutil.Discard)
+
+	for _, test := range []struct {
+		source   string
+		expected interface{}
+	}{
+		{"var a = 2\na * 21", 42.0},
+		{`"%(a)" + "!" // trailing comment`, "2!"},
+		{"[1, 2, 3]\n  .count", 3.0},
+		{"[1, 2, 3].map {|x|\n  x * a\n}.toList[2]", 6.0},
+		{"class Foo {}", nil},
+		{"for (i in 1..3) {\n  a = a + i\n}", nil},
+		{"a", 8.0},
+		{`System.print("hi")`, "hi"},
+		{"1 +\n  2", 3.0},
+		{"a = 5", 5.0},
+	} {
+		value, err := vm.InterpretValue(test.source)
+		if err != nil {
+			t.Errorf("%q failed: %v", test.source, err)
+			continue
 		}
-	}()
+		if value != test.expected {
+			t.Errorf("%q returned %v, expected %v", test.source, value, test.expected)
+		}
+	}
 
-	// This call should panic.
-	vm.Interpret(`GoMath.add("x", "y")`)
-}
+	if _, err := vm.VariableFrom("main", "GoResult"); err == nil {
+		t.Error("InterpretValue left a variable behind in the main module")
+	}
 
-func TestForeignClass(t *testing.T) {
-	type God struct {
-		msg string
+	// Errors are reported against the lines of the source as it was given, and only
+	// once, by a single run.
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	var buf bytes.Buffer
+	vm.SetOutputWriter(&buf)
+	_, err := vm.InterpretValue("System.print(\"once\")\n\na +* 2")
+	var compileErr *wren.CompileError
+	if !errors.As(err, &compileErr) || compileErr.Line != 3 || compileErr.Source != "a +* 2" {
+		t.Errorf("expected a compile error on line 3, got %v", err)
+	}
+	if kind := vm.LastErrorKind(); kind != wren.ErrorKindCompile {
+		t.Errorf("expected a compile error kind, got %v", kind)
+	}
+	if _, err := vm.InterpretValue("System.print(\"once\")\nFiber.abort(\"oops\")"); !errors.Is(err, wren.ErrRuntime) {
+		t.Errorf("expected a runtime error, got %v", err)
+	}
+	if kind := vm.LastErrorKind(); kind != wren.ErrorKindRuntime {
+		t.Errorf("expected a runtime error kind, got %v", kind)
+	}
+	if buf.String() != "once\n" {
+		t.Errorf("expected the script to run once, got output %q", buf.String())
 	}
+}
 
+func TestInterpretCapture(t *testing.T) {
 	var buf bytes.Buffer
 	vm := wren.NewVM()
+	defer vm.Close()
 	vm.SetOutputWriter(&buf)
 
-	vm.RegisterForeignClass("God", func() interface{} {
-		return &God{msg: "Do my bidding, %s!"}
-	})
+	out, err := vm.InterpretCapture(`System.print("captured")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "captured\n" {
+		t.Errorf("unexpected captured output: %s", out)
+	}
 
-	vm.RegisterForeignMethod("God.getMessage(_)", func(g *God, name string) string {
-		return fmt.Sprintf(g.msg, name)
-	})
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	if out, err := vm.InterpretCapture(`System.print("before")
+		Fiber.abort("oops")`); err == nil || out != "before\n" {
+		t.Errorf("unexpected result from failing script: %q, %v", out, err)
+	}
 
-	if err := vm.Interpret(`
-		foreign class God {
-			construct new() {}
-			foreign getMessage(name)
+	if err := vm.Interpret(`System.print("restored")`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "restored\n" {
+		t.Errorf("output writer was not restored: %s", buf.String())
+	}
+}
+
+func TestInterpretTimeout(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	err := vm.InterpretTimeout(`
+		class Go {
+			foreign static tick()
 		}
 
-		var god = God.new()
-		System.print(god.getMessage("Damien"))
+		while (true) {
+			Go.tick()
+		}
+	`, 50*time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Scripts that finish in time aren't affected.
+	if err := vm.InterpretTimeout(`Go.tick()`, time.Second); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInterpretContextCancellation(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		nested []error
+	)
+	if err := vm.RegisterForeignMethod("static GoCancel.now()", func() {
+		cancel()
+		// Give the cancellation time to be noticed.
+		time.Sleep(10 * time.Millisecond)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoCancel.nested()", func() {
+		nested = append(nested, vm.InterpretContext(context.Background(), `Go.tick()`))
+		time.Sleep(time.Millisecond)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.InterpretContext(context.Background(), `
+		class Go {
+			foreign static tick()
+		}
+		class GoCancel {
+			foreign static now()
+			foreign static nested()
+		}
 	`); err != nil {
-		t.Log(err.Error())
-		t.FailNow()
+		t.Fatal(err)
 	}
 
-	if buf.String() != "Do my bidding, Damien!\n" {
-		t.Errorf("unexpected output: %s", buf.String())
+	// Cancelling once the script no longer calls Go.tick() doesn't fail it.
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := vm.InterpretContext(ctx, `GoCancel.now()`); err != nil {
+		t.Errorf("a script that finished was reported as failing: %v", err)
+	}
+
+	// A nested call fails without clearing the outer call's cancellation.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err := vm.InterpretContext(ctx, `
+		for (i in 1..1000) {
+			GoCancel.nested()
+			Go.tick()
+		}
+	`)
+	if err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(nested) == 0 || nested[0] != wren.ErrReentrant {
+		t.Errorf("unexpected errors from nested calls: %v", nested)
 	}
 }
 
-func TestCallWren(t *testing.T) {
+func TestCallContext(t *testing.T) {
 	vm := wren.NewVM()
+	defer vm.Close()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	if err := vm.InterpretContext(context.Background(), `
+		class Go {
+			foreign static tick()
+		}
 
+		class Worker {
+			static spin() {
+				while (true) {
+					Go.tick()
+				}
+			}
+			static add(a, b) {
+				Go.tick()
+				return a + b
+			}
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	worker := vm.Variable("Worker")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := worker.CallContext(ctx, "spin()"); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Methods that finish in time aren't affected.
+	if n, err := worker.CallContext(context.Background(), "add(_,_)", 1, 2); err != nil || n != 3.0 {
+		t.Errorf("unexpected result: %v, %v", n, err)
+	}
+
+	// Nor are methods that have stopped calling Go.tick() by the time ctx is done.
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := vm.RegisterForeignMethod("static Canceller.cancel()", func() {
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+	}); err != nil {
+		t.Fatal(err)
+	}
 	if err := vm.Interpret(`
-		class WrenMath {
-			static do_add(a, b) {
+		class Canceller {
+			foreign static cancel()
+			static add(a, b) {
+				Go.tick()
+				cancel()
 				return a + b
 			}
 		}
 	`); err != nil {
-		t.Log(err.Error())
-		t.FailNow()
+		t.Fatal(err)
+	}
+	if n, err := vm.Variable("Canceller").CallContext(ctx, "add(_,_)", 1, 2); err != nil || n != 3.0 {
+		t.Errorf("unexpected result: %v, %v", n, err)
 	}
 
-	x, err := vm.Variable("WrenMath").Call("do_add(_,_)", 2, 3)
-	if err != nil {
-		t.Log(err)
-		t.FailNow()
+	// Calling from within a foreign method fails without disturbing the outer call.
+	var nested error
+	if err := vm.RegisterForeignMethod("static Nester.nested()", func() {
+		_, nested = worker.CallContext(context.Background(), "add(_,_)", 1, 2)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class Nester {
+			foreign static nested()
+			static run() {
+				nested()
+				Go.tick()
+			}
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := vm.Variable("Nester").CallContext(ctx, "run()"); err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if nested != wren.ErrReentrant {
+		t.Errorf("unexpected error from the nested call: %v", nested)
 	}
+}
 
-	n, ok := x.(float64)
-	if !ok {
-		t.Logf("WrenMath.add(2, 3) returned unexpected value: %v", x)
+func TestInterpretBytes(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := vm.InterpretBytes("main", []byte(`System.print("Hello, bytes!")`)); err != nil {
+		t.Log("interpretation error: ", err)
 		t.FailNow()
 	}
+	if buf.String() != "Hello, bytes!\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
 
-	if n != 5 {
-		t.Errorf("WrenMath.add(2, 3) returned unexpected value: %v", x)
+func TestInterpretStream(t *testing.T) {
+	var got []string
+	printed := make(chan struct{}, 1)
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputFunc(func(s string) {
+		got = append(got, s)
+		select {
+		case printed <- struct{}{}:
+		default:
+		}
+	})
+
+	// The first chunk has to run before the rest of the stream is written, as soon as
+	// the start of the next one shows that it's complete.
+	r, w := io.Pipe()
+	go func() {
+		fmt.Fprint(w, "class Greeter {\n  static greet(name) {\n\n    System.print(\"Hello, %(name)!\")\n  }\n}\n\nGreeter.greet(\"stream\")\n\nGreeter.greet(\"again\")\n")
+		<-printed
+		fmt.Fprint(w, "\nGreeter.missing()\n\nGreeter.greet(\"never\")\n")
+		w.Close()
+	}()
+
+	if err := vm.InterpretStream(r); err == nil {
+		t.Error("expected the failing chunk to stop the stream")
+	}
+	if strings.Join(got, "") != "Hello, stream!\nHello, again!\n" {
+		t.Errorf("unexpected output: %q", got)
+	}
+
+	// Statements that carry on past a blank line are interpreted whole, just as they
+	// would be by Interpret.
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	for _, source := range []string{
+		"var x = 1 +\n\n  2\nSystem.print(x)\n",
+		"if (false) {\n  System.print(\"yes\")\n}\n\nelse {\n  System.print(\"no\")\n}\n",
+		"var list = [1, 2]\n\n  .map {|n| n * 2 }\n\n  .toList\nSystem.print(list)\n",
+		"var s = \"a\n\nb\"\n\nSystem.print(s.count)\n",
+	} {
+		var whole, streamed bytes.Buffer
+		wholeVM, streamVM := wren.NewVM(), wren.NewVM()
+		defer wholeVM.Close()
+		defer streamVM.Close()
+		wholeVM.SetOutputWriter(&whole)
+		streamVM.SetOutputWriter(&streamed)
+		wholeErr := wholeVM.Interpret(source)
+		streamErr := streamVM.InterpretStream(strings.NewReader(source))
+		if (wholeErr == nil) != (streamErr == nil) || whole.String() != streamed.String() {
+			t.Errorf("%q streamed as %q, %v; expected %q, %v", source, streamed.String(), streamErr, whole.String(), wholeErr)
+		}
 	}
 }
 
-func TestLoadModule(t *testing.T) {
+func TestLoadOnce(t *testing.T) {
+	var buf bytes.Buffer
 	vm := wren.NewVM()
-	wren.SetModulesDir("testdata/modules")
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
 
-	if err := vm.Interpret(`import "hello" for Hello
-		Hello.World()`); err != nil {
-		t.Log("module load error: ", err)
-		t.FailNow()
+	const lib = `
+		System.print("loading lib")
+		class Lib {
+			static answer { 42 }
+		}
+	`
+	for i := 0; i < 3; i++ {
+		if err := vm.LoadOnce("lib", lib); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := vm.Interpret(`
+		import "lib" for Lib
+		System.print(Lib.answer)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "loading lib\n42\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestPool(t *testing.T) {
+	var setups int
+	pool := wren.NewPool(1, func(vm *wren.VM) error {
+		setups++
+		vm.SetOutputWriter(ioutil.Discard)
+		return vm.RegisterForeignMethod("static Pooled.id()", func() int { return setups })
+	})
+	defer pool.Close()
+
+	vm, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`System.print("pooled")`); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(vm)
+	if reused, err := pool.Get(); err != nil || reused != vm {
+		t.Errorf("expected the idle VM back, got %p, %v", reused, err)
+	}
+
+	// Only one VM is kept idle; the other is closed as it's returned.
+	other, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setups != 2 {
+		t.Errorf("expected setup to run twice, ran %d times", setups)
+	}
+	if err := other.Interpret(`var x = 1`); err != nil {
+		t.Fatal(err)
+	}
+	x := other.Variable("x")
+	pool.Put(vm)
+	pool.Put(other)
+	if _, err := x.Call("toString"); err != wren.ErrClosed {
+		t.Errorf("expected the evicted VM to be closed, got %v", err)
+	}
+
+	failing := wren.NewPool(1, func(vm *wren.VM) error {
+		return errors.New("setup failed")
+	})
+	if vm, err := failing.Get(); vm != nil || err == nil || err.Error() != "setup failed" {
+		t.Errorf("expected setup's error, got %v, %v", vm, err)
+	}
+}
+
+func TestForeignMethod(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := vm.RegisterForeignMethod("static GoMath.add(_,_)", func(a, b int) int {
+		return a + b
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoMath {
+			foreign static add(x, y)
+		}
+
+		System.write(GoMath.add(2, 3))
+	`); err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+
+	if buf.String() != "5" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	if err := vm.Interpret(`GoMath.add("x", "y")`); err == nil {
+		t.Error("GoMath.add(_,_) call succeeded with invalid parameters")
+	}
+}
+
+func TestForeignPanicCatchable(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoFail.now()", func() {
+		panic("something broke")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := vm.InterpretValue(`
+		class GoFail {
+			foreign static now()
+		}
+
+		Fiber.new { GoFail.now() }.try()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "something broke" {
+		t.Errorf("unexpected error caught by Wren: %v", value)
+	}
+}
+
+func TestLargeIntegers(t *testing.T) {
+	var got int64
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoBig.take(_)", func(n int64) {
+		got = n
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoBig {
+			foreign static take(n)
+		}
+
+		GoBig.take(-9007199254740992)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if got != -1<<53 {
+		t.Errorf("unexpected value at the precision boundary: %d", got)
+	}
+
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	if err := vm.Interpret(`GoBig.take(9007199254740994)`); err == nil {
+		t.Error("GoBig.take(_) accepted a number beyond 2^53")
+	}
+}
+
+func TestNumberRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := vm.RegisterForeignMethod("static GoNum.echo(_,_,_,_,_,_)", func(i8 int8, i int, i64 int64, u8 uint8, u64 uint64, f32 float32) string {
+		return fmt.Sprint(i8, i, i64, u8, u64, f32)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoNum {
+			foreign static echo(a, b, c, d, e, f)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		args, expected string
+	}{
+		{"0, 0, 0, 0, 0, 0", "0 0 0 0 0 0"},
+		{"-128, -1, -9007199254740992, 255, 9007199254740992, -0.5", "-128 -1 -9007199254740992 255 9007199254740992 -0.5"},
+		{"127, 2147483648, 42, 1, 18, 1.25", "127 2147483648 42 1 18 1.25"},
+	} {
+		buf.Reset()
+		if err := vm.Interpret(fmt.Sprintf("System.write(GoNum.echo(%s))", test.args)); err != nil {
+			t.Errorf("echo(%s) failed: %v", test.args, err)
+			continue
+		}
+		if buf.String() != test.expected {
+			t.Errorf("echo(%s) returned %q, expected %q", test.args, buf.String(), test.expected)
+		}
+	}
+
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	for _, args := range []string{
+		"1.5, 0, 0, 0, 0, 0",   // fractional into int8
+		"0, 0, -0.25, 0, 0, 0", // fractional into int64
+		"128, 0, 0, 0, 0, 0",   // overflows int8
+		"0, 0, 0, -1, 0, 0",    // negative into uint8
+	} {
+		if err := vm.Interpret("GoNum.echo(" + args + ")"); err == nil {
+			t.Errorf("echo(%s) succeeded with invalid parameters", args)
+		}
+	}
+}
+
+func TestBoolParams(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoBool.str(_)", func(s string) string {
+		return s + "!"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoBool.int(_)", func(n int) int {
+		return n + 10
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoBool.float(_)", func(f float64) float64 {
+		return f
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoBool {
+			foreign static str(s)
+			foreign static int(n)
+			foreign static float(f)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for source, expected := range map[string]interface{}{
+		"GoBool.str(true)":  "true!",
+		"GoBool.str(false)": "false!",
+		"GoBool.int(true)":  11.0,
+		"GoBool.int(false)": 10.0,
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+
+	value, err := vm.InterpretValue(`Fiber.new { GoBool.float(true) }.try()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "can't convert a bool to float64" {
+		t.Errorf("unexpected error: %v", value)
+	}
+}
+
+func TestSpecialNumbers(t *testing.T) {
+	var messages []string
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetErrorFunc(func(errType, module string, line int, msg string) {
+		if errType == wren.ErrorTypeRuntime {
+			messages = append(messages, msg)
+		}
+	})
+	if err := vm.RegisterForeignMethod("static GoSpecial.float(_)", func(f float64) float64 {
+		return f
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoSpecial.int(_)", func(i int) int {
+		return i
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoSpecial {
+			foreign static float(f)
+			foreign static int(i)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Special values pass through float parameters untouched.
+	for _, source := range []string{"GoSpecial.float(0/0).isNan", "GoSpecial.float(1/0) == 1/0", "GoSpecial.float(-1/0) == -1/0"} {
+		if value, err := vm.InterpretValue(source); err != nil || value != true {
+			t.Errorf("%s returned %v, %v", source, value, err)
+		}
+	}
+
+	for args, expected := range map[string]string{
+		"0/0":  "number nan is not finite and can't be converted to int",
+		"1/0":  "number infinity is not finite and can't be converted to int",
+		"-1/0": "number -infinity is not finite and can't be converted to int",
+	} {
+		messages = nil
+		if err := vm.Interpret("GoSpecial.int(" + args + ")"); err == nil {
+			t.Errorf("int(%s) succeeded", args)
+		}
+		if len(messages) != 1 || messages[0] != expected {
+			t.Errorf("int(%s) failed with unexpected messages: %q", args, messages)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	var (
+		buf     bytes.Buffer
+		current float64
+	)
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	if err := vm.RegisterForeignMethod("static GoNumber.get()", func() float64 { return current }); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoNumber {
+			foreign static get()
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []float64{5, -5, 0.1, 1.5, 1 / 3.0, 100000, 1e20, 1e-5, 123456789012345678, math.Inf(1), math.Inf(-1), math.NaN()} {
+		buf.Reset()
+		current = n
+		if err := vm.Interpret(`System.write(GoNumber.get())`); err != nil {
+			t.Fatal(err)
+		}
+		if s := wren.FormatNumber(n); s != buf.String() {
+			t.Errorf("FormatNumber(%v) returned %q, but Wren printed %q", n, s, buf.String())
+		}
+	}
+}
+
+func TestBigNumbers(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := vm.RegisterForeignMethod("static GoBigNum.double(_)", func(n *big.Int) *big.Int {
+		return n.Mul(n, big.NewInt(2))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoBigNum {
+			foreign static double(n)
+		}
+
+		System.print(GoBigNum.double("123456789012345678901234567890"))
+		System.print(GoBigNum.double(21))
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "246913578024691357802469135780\n42\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestUnsupportedReturnType(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoComplex.get()", func() complex128 {
+		return 1 + 2i
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	vm.SetErrorFunc(func(errType, module string, line int, msg string) {
+		if errType == wren.ErrorTypeRuntime {
+			messages = append(messages, msg)
+		}
+	})
+
+	if err := vm.Interpret(`
+		class GoComplex {
+			foreign static get()
+		}
+
+		GoComplex.get()
+	`); err == nil {
+		t.Error("returning an unsupported type succeeded")
+	}
+	if expected := (&wren.UnsupportedTypeError{Type: reflect.TypeOf(1 + 2i)}).Error(); len(messages) != 1 || messages[0] != expected {
+		t.Errorf("unexpected error messages: %q", messages)
+	}
+}
+
+func TestUnsupportedCallParams(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	other := wren.NewVM()
+	defer other.Close()
+
+	if err := vm.Interpret(`
+		class Echo {
+			static call(x) { x }
+		}
+		var released = [1]
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Interpret(`var foreign = [2]`); err != nil {
+		t.Fatal(err)
+	}
+	released := vm.Variable("released")
+	vm.ReleaseValue(released)
+	foreign := other.Variable("foreign")
+	echo := vm.Variable("Echo")
+
+	for _, test := range []struct {
+		param    interface{}
+		expected string
+	}{
+		{1 + 2i, (&wren.UnsupportedTypeError{Type: reflect.TypeOf(1 + 2i)}).Error()},
+		{make(chan int), (&wren.UnsupportedTypeError{Type: reflect.TypeOf(make(chan int))}).Error()},
+		{released, wren.ErrReleased.Error()},
+		{foreign, "can't pass a value between virtual machines"},
+		{map[struct{ X int }]int{{1}: 1}, "can't use struct { X int } as a Wren map key"},
+	} {
+		if _, err := echo.Call("call(_)", test.param); err == nil || err.Error() != test.expected {
+			t.Errorf("calling with %T returned %v, expected %q", test.param, err, test.expected)
+		}
+	}
+
+	// The failed calls leave the virtual machine usable.
+	if x, err := echo.Call("call(_)", 3); err != nil || x != 3.0 {
+		t.Errorf("unexpected result after failed calls: %v, %v", x, err)
+	}
+}
+
+func TestPointerReturn(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	name := "Zeus"
+	if err := vm.RegisterForeignMethod("static GoPtr.name()", func() *string {
+		return &name
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoPtr.missing()", func() *int {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoPtr.any()", func() interface{} {
+		return 3
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoPtr {
+			foreign static name()
+			foreign static missing()
+			foreign static any()
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		"GoPtr.name()":    "Zeus",
+		"GoPtr.missing()": nil,
+		"GoPtr.any()":     3.0,
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+}
+
+func TestInterfaceReturn(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoAny.list()", func() interface{} {
+		return []interface{}{1, "two", nil, []interface{}{true}}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoAny.map()", func() interface{} {
+		return map[string]interface{}{"a": 1, "b": nil, "c": map[interface{}]interface{}{2: "x"}}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoAny.nothing()", func() interface{} {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoAny.badKey()", func() interface{} {
+		return map[interface{}]int{[1]int{1}: 1}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoAny {
+			foreign static list()
+			foreign static map()
+			foreign static nothing()
+			foreign static badKey()
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		`GoAny.list().toString`:        "[1, two, null, [true]]",
+		`GoAny.map()["a"]`:             1.0,
+		`GoAny.map().containsKey("b")`: true,
+		`GoAny.map()["c"][2]`:          "x",
+		`GoAny.nothing()`:              nil,
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+
+	value, err := vm.InterpretValue(`Fiber.new { GoAny.badKey() }.try()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "can't use [1]int as a Wren map key" {
+		t.Errorf("unexpected error: %v", value)
+	}
+}
+
+func TestNonStringMapKeys(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoKeys.shout(_)", func(m map[int]string) map[int]string {
+		result := make(map[int]string, len(m))
+		for k, v := range m {
+			result[k*10] = strings.ToUpper(v)
+		}
+		return result
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoKeys.flip(_)", func(m map[bool]int) map[bool]int {
+		return map[bool]int{true: m[false], false: m[true]}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoKeys.floats()", func() map[float64]bool {
+		return map[float64]bool{0.5: true, -1: false}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoKeys {
+			foreign static shout(m)
+			foreign static flip(m)
+			foreign static floats()
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		`GoKeys.shout({1: "a", 2: "b"})[20]`:        "B",
+		`GoKeys.shout({1: "a", 2: "b"}).count`:      2.0,
+		`GoKeys.shout({}).count`:                    0.0,
+		`GoKeys.flip({true: 1, false: 2})[true]`:    2.0,
+		`GoKeys.flip({true: 1, false: 2})[false]`:   1.0,
+		`GoKeys.flip({true: 1}).containsKey(false)`: true,
+		`GoKeys.floats()[0.5]`:                      true,
+		`GoKeys.floats()[-1]`:                       false,
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+
+	// Going the other way, Call returns them with their keys intact.
+	value, err := vm.InterpretValue(`GoKeys.shout({3: "c"})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := value.(map[interface{}]interface{}); !ok || len(m) != 1 || m[30.0] != "C" {
+		t.Errorf("unexpected result: %#v", value)
+	}
+}
+
+func TestByteArrays(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoHash.md5(_)", func(s string) [md5.Size]byte {
+		return md5.Sum([]byte(s))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoHash.hex(_)", func(sum [md5.Size]byte) string {
+		return hex.EncodeToString(sum[:])
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoHash {
+			foreign static md5(s)
+			foreign static hex(sum)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		`GoHash.md5("abc").bytes.count`: 16.0,
+		`GoHash.hex(GoHash.md5("abc"))`: "900150983cd24fb0d6963f7d28e17f72",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+
+	value, err := vm.InterpretValue(`Fiber.new { GoHash.hex("too short") }.try()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "can't convert a string of 9 bytes to [16]uint8" {
+		t.Errorf("unexpected error: %v", value)
+	}
+}
+
+func TestMultipleReturns(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoMulti.divmod(_,_)", func(a, b int) (int, int) {
+		return a / b, a % b
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoMulti.parse(_)", func(s string) (int, string, error) {
+		var n int
+		_, err := fmt.Sscan(s, &n)
+		return n, s, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoMulti.names()", func() []string {
+		return []string{"a", "b"}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoMulti {
+			foreign static divmod(a, b)
+			foreign static parse(s)
+			foreign static names()
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		`GoMulti.divmod(7, 2).join(",")`: "3,1",
+		`GoMulti.parse("12").join(",")`:  "12,12",
+		`GoMulti.names().join(",")`:      "a,b",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	if err := vm.Interpret(`GoMulti.parse("twelve")`); err == nil {
+		t.Error("expected returning an error to fail the call")
+	}
+}
+
+func TestOptionalReturn(t *testing.T) {
+	users := map[string]int{"ada": 36, "bob": 0}
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoUsers.age(_)", func(name string) (int, bool) {
+		age, ok := users[name]
+		return age, ok
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoUsers.lookup(_)", func(name string) (int, bool, error) {
+		if name == "" {
+			return 0, false, errors.New("no name given")
+		}
+		age, ok := users[name]
+		return age, ok, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoUsers {
+			foreign static age(name)
+			foreign static lookup(name)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// By default, the pair is returned as a list like any other.
+	for source, expected := range map[string]interface{}{
+		`GoUsers.age("ada").join(",")`:    "36,true",
+		`GoUsers.age("eve").join(",")`:    "0,false",
+		`GoUsers.lookup("ada").join(",")`: "36,true",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+
+	vm.OptionalResults(true)
+	for source, expected := range map[string]interface{}{
+		`GoUsers.age("ada")`:                     36.0,
+		`GoUsers.age("bob")`:                     0.0,
+		`GoUsers.age("eve")`:                     nil,
+		`GoUsers.lookup("ada")`:                  36.0,
+		`GoUsers.lookup("eve")`:                  nil,
+		`Fiber.new { GoUsers.lookup("") }.try()`: "no name given",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+}
+
+type stringerColor int
+
+func (c stringerColor) String() string {
+	return [...]string{"Red", "Green", "Blue"}[c]
+}
+
+func TestUseStringers(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoEnum.color()", func() stringerColor {
+		return 1
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoEnum.colors()", func() []stringerColor {
+		return []stringerColor{0, 2}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoEnum.timeout()", func() time.Duration {
+		return 1500 * time.Millisecond
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoEnum {
+			foreign static color()
+			foreign static colors()
+			foreign static timeout()
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, use := range []bool{false, true} {
+		vm.UseStringers(use)
+		expectations := map[string]interface{}{
+			"GoEnum.color()":            1.0,
+			`GoEnum.colors().join(",")`: "0,2",
+			"GoEnum.timeout()":          1.5e9,
+		}
+		if use {
+			expectations = map[string]interface{}{
+				"GoEnum.color()":            "Green",
+				`GoEnum.colors().join(",")`: "Red,Blue",
+				"GoEnum.timeout()":          "1.5s",
+			}
+		}
+		for source, expected := range expectations {
+			value, err := vm.InterpretValue(source)
+			if err != nil {
+				t.Errorf("%s failed: %v", source, err)
+			} else if value != expected {
+				t.Errorf("%s returned %v with UseStringers(%t), expected %v", source, value, use, expected)
+			}
+		}
+	}
+}
+
+func TestErrorOnlyReturn(t *testing.T) {
+	var saved []string
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoStore.save(_)", func(s string) error {
+		if s == "" {
+			return errors.New("nothing to save")
+		}
+		saved = append(saved, s)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoStore {
+			foreign static save(s)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	value, err := vm.InterpretValue(`GoStore.save("a")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Errorf("expected a successful call to return null, got %v", value)
+	}
+	if fmt.Sprint(saved) != "[a]" {
+		t.Errorf("unexpected saved values: %v", saved)
+	}
+
+	value, err = vm.InterpretValue(`Fiber.new { GoStore.save("") }.try()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "nothing to save" {
+		t.Errorf("expected the error to abort the fiber, got %v", value)
+	}
+}
+
+func TestCallHooks(t *testing.T) {
+	var trace []string
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetCallHooks(func(method string) {
+		trace = append(trace, "before "+method)
+	}, func(method string, elapsed time.Duration, err error) {
+		trace = append(trace, fmt.Sprintf("after %s %v", method, err))
+	})
+	if err := vm.RegisterForeignMethod("static GoTrace.check()", func() bool {
+		return vm.InCall()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.InCall() {
+		t.Error("InCall returned true outside of a call")
+	}
+	value, err := vm.InterpretValue(`
+		class GoTrace {
+			foreign static check()
+		}
+		GoTrace.check()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != true {
+		t.Error("InCall returned false inside of a foreign method")
+	}
+	if fmt.Sprint(trace) != "[before static GoTrace.check() after static GoTrace.check() <nil>]" {
+		t.Errorf("unexpected trace: %v", trace)
+	}
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	caller, registrar := wren.NewVM(), wren.NewVM()
+	defer caller.Close()
+	defer registrar.Close()
+
+	if err := caller.RegisterForeignMethod("static GoCounter.next()", func() int {
+		return 1
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Registering on one VM while another VM invokes its foreign methods
+	// should be safe; run with -race to verify.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 8; i++ {
+			if err := registrar.RegisterForeignMethod(fmt.Sprintf("static GoNoop.f%d()", i), func() {}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	if err := caller.Interpret(`
+		class GoCounter {
+			foreign static next()
+		}
+
+		for (i in 0...100) GoCounter.next()
+	`); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
+
+func TestReentrantInterpret(t *testing.T) {
+	var reentrantErr error
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoReentrant.run()", func() {
+		reentrantErr = vm.Interpret(`System.print("nested")`)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoReentrant {
+			foreign static run()
+		}
+
+		GoReentrant.run()
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if reentrantErr != wren.ErrReentrant {
+		t.Errorf("unexpected error from re-entrant Interpret: %v", reentrantErr)
+	}
+}
+
+func TestData(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	vm.SetData("greeting", "Hello from the host!")
+
+	if err := vm.RegisterForeignMethod("static GoHost.greeting()", func(vm *wren.VM) string {
+		return vm.GetData("greeting").(string)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoHost {
+			foreign static greeting()
+		}
+
+		System.print(GoHost.greeting())
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "Hello from the host!\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+
+	vm.SetData("greeting", nil)
+	if v := vm.GetData("greeting"); v != nil {
+		t.Errorf("unexpected data after removal: %v", v)
+	}
+}
+
+func TestForeignMethodVM(t *testing.T) {
+	type Tally struct {
+		n int
+	}
+
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	vm.SetData("step", 5)
+
+	if err := vm.RegisterForeignClass("Tally", func() interface{} {
+		return &Tally{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The *VM comes first, ahead of the receiver.
+	if err := vm.RegisterForeignMethod("Tally.bump()", func(vm *wren.VM, tally *Tally) int {
+		tally.n += vm.GetData("step").(int)
+		return tally.n
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class Tally {
+			construct new() {}
+			foreign bump()
+		}
+
+		var tally = Tally.new()
+		tally.bump()
+		System.print(tally.bump())
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "10\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestForeignOperators(t *testing.T) {
+	type Row struct {
+		cells [4]float64
+	}
+
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := vm.RegisterForeignClass("Row", func() interface{} {
+		return &Row{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Row.[_]", func(r *Row, i int) float64 {
+		return r.cells[i]
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Row.[_]=(_)", func(r *Row, i int, v float64) {
+		r.cells[i] = v
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Row.+(_)", func(r, other *Row) float64 {
+		var sum float64
+		for i := range r.cells {
+			sum += r.cells[i] + other.cells[i]
+		}
+		return sum
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class Row {
+			construct new() {}
+			foreign [index]
+			foreign [index]=(value)
+			foreign +(other)
+		}
+
+		var a = Row.new()
+		var b = Row.new()
+		a[1] = 2
+		b[3] = 5
+		System.print(a[1])
+		System.print(a + b)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "2\n7\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestForeignProperty(t *testing.T) {
+	type Sign struct {
+		message string
+	}
+
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := vm.RegisterForeignClass("Sign", func() interface{} {
+		return &Sign{message: "Keep out"}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Sign.message", func(s *Sign) string {
+		return s.message
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Sign.message=(_)", func(s *Sign, message string) {
+		s.message = message
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class Sign {
+			construct new() {}
+			foreign message
+			foreign message=(value)
+		}
+
+		var sign = Sign.new()
+		System.print(sign.message)
+		sign.message = "Welcome"
+		System.print(sign.message)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "Keep out\nWelcome\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+type calculator struct {
+	base int
+}
+
+func (c *calculator) Add(a, b int) int {
+	return c.base + a + b
+}
+
+func (c *calculator) Base() int {
+	return c.base
+}
+
+func TestForeignStruct(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := vm.RegisterForeignStruct("Calc", &calculator{base: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class Calc {
+			foreign static add(a, b)
+			foreign static base()
+		}
+
+		System.print(Calc.add(1, 2))
+		System.print(Calc.base())
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "103\n100\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestForeignClassRef(t *testing.T) {
+	type Locked struct {
+		sync.Mutex
+		n int
+	}
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	locked := &Locked{}
+
+	if err := vm.RegisterForeignClassRef("Locked", func() interface{} {
+		return locked
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Locked.incr()", func(l *Locked) {
+		l.Lock()
+		defer l.Unlock()
+		l.n++
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class Locked {
+			construct new() {}
+			foreign incr()
+		}
+
+		var locked = Locked.new()
+		locked.incr()
+		locked.incr()
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if locked.n != 2 {
+		t.Errorf("foreign methods didn't operate on the original value: n = %d", locked.n)
+	}
+}
+
+func TestForeignClassRefPinning(t *testing.T) {
+	type Box struct {
+		n int
+	}
+
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	var next int
+	if err := vm.RegisterForeignClassRef("Box", func() interface{} {
+		next++
+		return &Box{n: next}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Box.n", func(b *Box) int {
+		return b.n
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class Box {
+			construct new() {}
+			foreign n
+		}
+
+		var boxes = []
+		for (i in 1..100) {
+			boxes.add(Box.new())
+			Box.new() // garbage
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Discard the garbage boxes, then give Go a chance to collect anything
+	// that isn't properly pinned.
+	vm.GC()
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+	}
+
+	if err := vm.Interpret(`System.print(boxes.reduce(0) {|sum, box| sum + box.n })`); err != nil {
+		t.Fatal(err)
+	}
+	// Boxes 1, 3, 5, ..., 199 were kept.
+	if buf.String() != "10000\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestStructToMap(t *testing.T) {
+	type Config struct {
+		Name    string `json:"name"`
+		Retries int    `json:"retries,omitempty"`
+		Secret  string `json:"-"`
+		Verbose bool
+		hidden  string
+	}
+
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := vm.RegisterForeignMethod("static GoConfig.get()", func() Config {
+		return Config{Name: "demo", Retries: 3, Secret: "hunter2", Verbose: true, hidden: "x"}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	const program = `
+		var c = GoConfig.get()
+		System.print(c.count)
+		for (key in ["name", "Name", "retries", "Retries", "Secret", "Verbose", "hidden"]) {
+			System.print("%(key)=%(c[key])")
+		}
+	`
+	if err := vm.Interpret(`
+		class GoConfig {
+			foreign static get()
+		}
+	` + program); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "4\nname=null\nName=demo\nretries=null\nRetries=3\nSecret=hunter2\nVerbose=true\nhidden=null\n" {
+		t.Errorf("unexpected output without json tags: %s", buf.String())
+	}
+
+	buf.Reset()
+	vm.UseJSONTags(true)
+	if err := vm.Interpret("{" + program + "}"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "3\nname=demo\nName=null\nretries=3\nRetries=null\nSecret=null\nVerbose=true\nhidden=null\n" {
+		t.Errorf("unexpected output with json tags: %s", buf.String())
+	}
+}
+
+func TestForeignClass(t *testing.T) {
+	type God struct {
+		msg string
+	}
+
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := vm.RegisterForeignClass("God", func() interface{} {
+		return &God{msg: "Do my bidding, %s!"}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.RegisterForeignMethod("God.getMessage(_)", func(g *God, name string) string {
+		return fmt.Sprintf(g.msg, name)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class God {
+			construct new() {}
+			foreign getMessage(name)
+		}
+
+		var god = God.new()
+		System.print(god.getMessage("Damien"))
+	`); err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+
+	if buf.String() != "Do my bidding, Damien!\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestForeignClassAllocHook(t *testing.T) {
+	type Conn struct {
+		ID int
+	}
+
+	var (
+		nextID    int
+		allocated []int
+	)
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignClass("Conn", func() interface{} {
+		nextID++
+		return Conn{ID: nextID}
+	}, func(x interface{}) {
+		allocated = append(allocated, x.(Conn).ID)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Registration calls f once without constructing anything.
+	if len(allocated) != 0 {
+		t.Fatalf("unexpected allocations during registration: %v", allocated)
+	}
+
+	if err := vm.Interpret(`
+		foreign class Conn {
+			construct open() {}
+		}
+		var a = Conn.open()
+		var b = Conn.open()
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(allocated, []int{2, 3}) {
+		t.Errorf("unexpected allocations: %v", allocated)
+	}
+}
+
+func TestForeignClassPanics(t *testing.T) {
+	type Thing struct{}
+
+	var registered bool
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignClass("Broken", func() interface{} {
+		if registered {
+			panic("broken allocator")
+		}
+		return Thing{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignClass("Empty", func() interface{} {
+		if registered {
+			return nil
+		}
+		return Thing{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignClass("Hooked", func() interface{} {
+		return Thing{}
+	}, func(interface{}) {
+		panic("broken hook")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignClassRef("NotRef", func() interface{} {
+		return Thing{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterGenerator("Rows", func() (<-chan interface{}, error) {
+		panic("broken generator")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	registered = true
+
+	if err := vm.Interpret(`
+		foreign class Broken {
+			construct new() {}
+		}
+		foreign class Empty {
+			construct new() {}
+		}
+		foreign class Hooked {
+			construct new() {}
+		}
+		foreign class NotRef {
+			construct new() {}
+		}
+		foreign class Rows {
+			construct new() {}
+			foreign iterate(iterator)
+			foreign iteratorValue(iterator)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, prefix := range map[string]string{
+		`Fiber.new { Broken.new() }.try()`: "broken allocator",
+		`Fiber.new { Empty.new() }.try()`:  "foreign class value must not be nil",
+		`Fiber.new { Hooked.new() }.try()`: "broken hook",
+		`Fiber.new { NotRef.new() }.try()`: "foreign class reference must be a pointer",
+		`Fiber.new { Rows.new() }.try()`:   "broken generator",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if msg, _ := value.(string); !strings.HasPrefix(msg, prefix) {
+			t.Errorf("%s returned %v, expected an error starting with %q", source, value, prefix)
+		}
+	}
+}
+
+func TestCallbackPanics(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	var lines []string
+	vm.SetOutputFunc(func(s string) {
+		if s == "boom" {
+			panic("broken output")
+		}
+		lines = append(lines, s)
+	})
+	err := vm.Interpret(`
+		System.write("before")
+		System.write("boom")
+		System.write("after")
+	`)
+	if err == nil || !strings.Contains(err.Error(), "broken output") {
+		t.Errorf("expected the output panic to be returned, got %v", err)
+	}
+	if fmt.Sprint(lines) != "[before]" {
+		t.Errorf("unexpected output: %q", lines)
+	}
+	if err := vm.Interpret(`System.write("again")`); err != nil {
+		t.Errorf("expected the next run to succeed, got %v", err)
+	}
+
+	vm.SetErrorFunc(func(errType, module string, line int, msg string) {
+		panic("broken error func")
+	})
+	err = vm.Interpret(`Fiber.abort("oops")`)
+	if err == nil || !strings.Contains(err.Error(), "broken error func") {
+		t.Errorf("expected the error func panic to be returned, got %v", err)
+	}
+}
+
+func TestGenericRegistration(t *testing.T) {
+	type Counter struct {
+		n int
+	}
+
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	if err := wren.RegisterClassRef(vm, "Counter", func() *Counter {
+		return &Counter{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wren.RegisterMethod(vm, "Counter.add(_)", func(c *Counter, n int) int {
+		c.n += n
+		return c.n
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wren.RegisterMethod(vm, "static Counter.describe(_)", func(vm *wren.VM, c *Counter) string {
+		return fmt.Sprintf("counted to %d", c.n)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, f := range map[string]interface{}{
+		"Counter.notAFunction":       42,
+		"Counter.tooFew(_,_)":        func(c *Counter) {},
+		"Counter.tooMany()":          func(c *Counter, n, m int) {},
+		"static Counter.receiver(_)": func(c *Counter, n int) {},
+		"Counter.variadic(_)":        func(ns ...int) {},
+		"noClass":                    func() {},
+	} {
+		if err := wren.RegisterMethod(vm, name, f); err == nil {
+			t.Errorf("expected registering %s to fail", name)
+		}
+	}
+
+	if err := vm.Interpret(`
+		foreign class Counter {
+			construct new() {}
+			foreign add(n)
+			foreign static describe(c)
+		}
+
+		var c = Counter.new()
+		c.add(2)
+		c.add(3)
+		System.print(Counter.describe(c))
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "counted to 5\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestWrenObjectParams(t *testing.T) {
+	var kept []*wren.Value
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoKeep.value(_)", func(v *wren.Value) {
+		kept = append(kept, v)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoKeep.any(_)", func(xs []interface{}) {
+		for _, x := range xs {
+			if v, ok := x.(*wren.Value); ok {
+				kept = append(kept, v)
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoKeep.number(_)", func(n int) int {
+		return n
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoKeep {
+			foreign static value(v)
+			foreign static any(xs)
+			foreign static number(n)
+		}
+
+		class Pet {
+			construct new(name) { _name = name }
+			name { _name }
+		}
+
+		GoKeep.value(Pet.new("Rex"))
+		GoKeep.value(42)
+		GoKeep.any([Pet.new("Tom"), 1, "two"])
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 3 {
+		t.Fatalf("expected 3 values, got %d", len(kept))
+	}
+	for i, expected := range []interface{}{"Rex", nil, "Tom"} {
+		if expected == nil {
+			if n, err := kept[i].Call("+(_)", 1); err != nil || n != 43.0 {
+				t.Errorf("unexpected result: %v, %v", n, err)
+			}
+			continue
+		}
+		if name, err := kept[i].Get("name"); err != nil || name != expected {
+			t.Errorf("unexpected name: %v, %v", name, err)
+		}
+	}
+
+	value, err := vm.InterpretValue(`Fiber.new { GoKeep.number(Pet.new("Rex")) }.try()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "can't convert a Wren object to int; use *wren.Value instead" {
+		t.Errorf("unexpected error: %v", value)
+	}
+}
+
+func TestForeignClassArgs(t *testing.T) {
+	type Vec struct {
+		X, Y float64
+	}
+	type Color struct {
+		R, G, B, A float64
+	}
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignClassArgs("Vec", func(x, y float64) Vec {
+		return Vec{X: x, Y: y}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignClassArgs("Color", func(args ...interface{}) interface{} {
+		c := Color{A: 1}
+		if channels, ok := args[0].(map[interface{}]interface{}); ok {
+			for key, f := range map[string]*float64{"r": &c.R, "g": &c.G, "b": &c.B, "a": &c.A} {
+				if n, ok := channels[key].(float64); ok {
+					*f = n
+				}
+			}
+			return c
+		}
+		for i, f := range []*float64{&c.R, &c.G, &c.B, &c.A}[:len(args)] {
+			*f = args[i].(float64)
+		}
+		return c
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignClassArgs("Bad", 42); err == nil {
+		t.Error("expected registering a non-function to fail")
+	}
+	if err := vm.RegisterForeignMethod("Vec.length", func(v *Vec) float64 {
+		return math.Hypot(v.X, v.Y)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Vec.+(_)", func(v, other *Vec) Vec {
+		return Vec{X: v.X + other.X, Y: v.Y + other.Y}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Color.alpha", func(c *Color) float64 {
+		return c.A
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class Vec {
+			construct new(x, y) {}
+			construct new(x) {}
+			foreign length
+			foreign +(other)
+		}
+
+		foreign class Color {
+			construct rgb(r, g, b) {}
+			construct rgba(r, g, b, a) {}
+			construct named(channels) {}
+			foreign alpha
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		"Vec.new(3, 4).length":                        5.0,
+		"(Vec.new(1, 1) + Vec.new(2, 3)).length":      5.0,
+		"Color.rgb(1, 0, 0).alpha":                    1.0,
+		"Color.rgba(1, 0, 0, 0.5).alpha":              0.5,
+		`Color.named({"r": 1, "a": 0.25}).alpha`:      0.25,
+		"Fiber.new { Vec.new(1) }.try()":              "constructor takes 2 arguments, but was given 1",
+		`Fiber.new { Vec.new("a", 1) }.try() != null`: true,
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterGenerator("Rows", func() (<-chan interface{}, error) {
+		ch := make(chan interface{})
+		go func() {
+			defer close(ch)
+			for i := 1; i <= 3; i++ {
+				ch <- map[string]interface{}{"id": i}
+			}
+		}()
+		return ch, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterGenerator("Broken", func() (<-chan interface{}, error) {
+		return nil, errors.New("no connection")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class Rows {
+			construct new() {}
+			foreign iterate(iterator)
+			foreign iteratorValue(iterator)
+		}
+
+		foreign class Broken {
+			construct new() {}
+			foreign iterate(iterator)
+			foreign iteratorValue(iterator)
+		}
+
+		class Total {
+			static ids(rows) {
+				var total = 0
+				for (row in rows) total = total + row["id"]
+				return total
+			}
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		`Total.ids(Rows.new())`:            6.0,
+		`Fiber.new { Broken.new() }.try()`: "no connection",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+}
+
+func TestRegisterConstants(t *testing.T) {
+	type Color int
+	const (
+		Red Color = iota
+		Green
+		Blue
+	)
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterConstants("Color", map[string]int{
+		"Red":   int(Red),
+		"Green": int(Green),
+		"Blue":  int(Blue),
+		"Azure": int(Blue),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"not valid", "null", "class", "_hidden", "9lives"} {
+		if err := vm.RegisterConstants("Bad", map[string]int{name: 1}); err == nil {
+			t.Errorf("expected the constant name %q to fail", name)
+		}
+	}
+	if err := vm.RegisterConstants("var", map[string]int{"A": 1}); err == nil {
+		t.Error("expected a reserved class name to fail")
+	}
+	// The class can't be added to once it's defined.
+	if err := vm.RegisterConstants("Color", map[string]int{"Cyan": 3}); err == nil || !strings.Contains(err.Error(), "already defined") {
+		t.Errorf("unexpected error registering more constants: %v", err)
+	}
+
+	for source, expected := range map[string]interface{}{
+		"Color.Green":               1.0,
+		"Color.Blue == Color.Azure": true,
+		"Color.name(Color.Red)":     "Red",
+		"Color.name(2)":             "Azure",
+		"Color.name(42)":            nil,
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+}
+
+func TestForeignList(t *testing.T) {
+	type God struct {
+		power int
+	}
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignClass("God", func() interface{} {
+		return &God{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("God.setPower(_)", func(g *God, power int) {
+		g.power = power
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Pantheon.power(_)", func(gods []*God) int {
+		var total int
+		for _, g := range gods {
+			total += g.power
+		}
+		return total
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Pantheon.sum(_)", func(ns []int) int {
+		var total int
+		for _, n := range ns {
+			total += n
+		}
+		return total
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Pantheon.describe(_)", func(xs []interface{}) string {
+		return fmt.Sprint(xs...)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class God {
+			construct new(power) {
+				setPower(power)
+			}
+			foreign setPower(power)
+		}
+
+		class Pantheon {
+			foreign static power(gods)
+			foreign static sum(ns)
+			foreign static describe(xs)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		"Pantheon.power([God.new(3), God.new(4)])": 7.0,
+		"Pantheon.sum([1, 2, 3])":                  6.0,
+		"Pantheon.power([])":                       0.0,
+		`Pantheon.describe(["a", 1, true])`:        "a1 true",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+}
+
+func TestForeignMap(t *testing.T) {
+	type Point struct {
+		X, Y int
+	}
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static Maps.describe(_)", func(m map[string]interface{}) string {
+		return fmt.Sprint(m)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Maps.total(_)", func(m map[string]int) int {
+		var total int
+		for _, n := range m {
+			total += n
+		}
+		return total
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Maps.nested(_)", func(m map[string][]map[string]bool) int {
+		return len(m["flags"])
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Maps.point(_)", func(p Point) int {
+		return p.X * p.Y
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Maps.points(_)", func(points []*Point) int {
+		return len(points)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Maps.anything(_)", func(x interface{}) string {
+		return fmt.Sprint(x)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class Maps {
+			foreign static describe(m)
+			foreign static total(m)
+			foreign static nested(m)
+			foreign static point(p)
+			foreign static points(p)
+			foreign static anything(x)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		`Maps.describe({"a": 1, "b": "two", "c": null})`:         "map[a:1 b:two c:<nil>]",
+		`Maps.total({"a": 1, "b": 2, "c": 3})`:                   6.0,
+		`Maps.total({})`:                                         0.0,
+		`Maps.nested({"flags": [{"on": true}, {"off": false}]})`: 2.0,
+		`Maps.point({"X": 3, "Y": 4, "Z": 5})`:                   12.0,
+		`Maps.points([{"X": 1}, {"Y": 2}])`:                      2.0,
+		`Maps.anything({1: "one"})`:                              "map[1:one]",
+		`Maps.anything([{"a": [true]}])`:                         "[map[a:[true]]]",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+
+	if _, err := vm.InterpretValue(`Maps.total({"a": "not a number"})`); err == nil {
+		t.Error("expected a map of the wrong types to fail the call")
+	}
+
+	// A method registered after its class was declared is still foreign, so it's never
+	// given the keys.
+	if err := vm.Interpret(`
+		class Late {
+			foreign static total(m)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Late.total(_)", func(m map[string]int) int {
+		return len(m)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	value, err := vm.InterpretValue(`Fiber.new { Late.total({"a": 1}) }.try()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "can't convert a map to map[string]int without its keys; register the foreign method before declaring its class, or take a *wren.Value instead" {
+		t.Errorf("unexpected error: %v", value)
+	}
+
+	// Outside of foreign methods, maps can be converted in full.
+	value, err = vm.InterpretValue(`{"a": 1, "b": [true], "c": null}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[interface{}]interface{}{"a": 1.0, "b": []interface{}{true}, "c": nil}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("unexpected map: %v", value)
+	}
+}
+
+func TestStructParams(t *testing.T) {
+	type Options struct {
+		Name    string `json:"name"`
+		Retries int    `json:"retries"`
+		Verbose bool   `json:"verbose"`
+	}
+	type Tagged struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	}
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.UseJSONTags(true)
+	if err := vm.RegisterForeignMethod("static Service.start(_)", func(opts Options) string {
+		return fmt.Sprintf("%s/%d/%t", opts.Name, opts.Retries, opts.Verbose)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Service.tag(_)", func(opts Tagged) string {
+		return fmt.Sprintf("%s/%v", opts.Name, opts.Labels)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class Service {
+			foreign static start(opts)
+			foreign static tag(opts)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strict := range []bool{false, true} {
+		vm.DisallowUnknownFields(strict)
+		for source, expected := range map[string]interface{}{
+			`Service.start({"name": "web", "retries": 3, "verbose": true})`: "web/3/true",
+			`Service.start({"name": "db"})`:                                 "db/0/false",
+			`Service.tag({"name": "web", "labels": {"env": "prod"}})`:       "web/map[env:prod]",
+		} {
+			value, err := vm.InterpretValue(source)
+			if err != nil {
+				t.Errorf("%s failed: %v", source, err)
+			} else if value != expected {
+				t.Errorf("%s returned %v, expected %v", source, value, expected)
+			}
+		}
+	}
+
+	const typo = `Fiber.new { Service.start({"name": "web", "retires": 3}) }.try()`
+	vm.DisallowUnknownFields(false)
+	if value, err := vm.InterpretValue(typo); err != nil {
+		t.Fatal(err)
+	} else if value != "web/0/false" {
+		t.Errorf("unknown key wasn't ignored: %v", value)
+	}
+	vm.DisallowUnknownFields(true)
+	if value, err := vm.InterpretValue(typo); err != nil {
+		t.Fatal(err)
+	} else if value != "map has 1 unknown field(s) for wren_test.Options; expected only name, retries, verbose" {
+		t.Errorf("unexpected error: %v", value)
+	}
+
+	// A struct with a map field is given the keys, so it can name the unknown one.
+	if value, err := vm.InterpretValue(`Fiber.new { Service.tag({"name": "web", "lables": {}}) }.try()`); err != nil {
+		t.Fatal(err)
+	} else if value != "unknown field lables for wren_test.Tagged; expected only name, labels" {
+		t.Errorf("unexpected error: %v", value)
+	}
+}
+
+func TestRange(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	var kept *wren.Value
+	if err := vm.RegisterForeignMethod("static GoRange.keep(_)", func(r *wren.Value) {
+		kept = r
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoRange {
+			foreign static keep(r)
+		}
+		class Point {
+			construct new() {}
+		}
+		GoRange.keep(1...4)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := kept.Range(); err != nil || r != (wren.Range{From: 1, To: 4}) {
+		t.Errorf("unexpected range from a foreign method: %v, %v", r, err)
+	}
+
+	// Foreign methods can take ranges directly, registered before their class.
+	if err := vm.RegisterForeignMethod("static GoRanges.describe(_)", func(r wren.Range) string {
+		return r.String()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoRanges.sum(_)", func(xs []int) int {
+		var sum int
+		for _, x := range xs {
+			sum += x
+		}
+		return sum
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoRanges {
+			foreign static describe(r)
+			foreign static sum(xs)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		"GoRanges.describe(1..3)":                            "1..3",
+		"GoRanges.describe(0...2.5)":                         "0...2.5",
+		"GoRanges.sum(1..3)":                                 6.0,
+		"GoRanges.sum(3...0)":                                6.0,
+		"GoRanges.sum([4, 5])":                               9.0,
+		"Fiber.new { GoRanges.sum(0..1e15) }.try()":          "can't expand 0..1e+15 to integers; it holds more than 1048576",
+		"Fiber.new { GoRanges.describe(Point.new()) }.try()": "can't convert a Wren object to wren.Range; use *wren.Value instead",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+
+	for source, expected := range map[string]string{
+		"1..10":   "1..10",
+		"0...2.5": "0...2.5",
+		"3..1":    "3..1",
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := value.(*wren.Value).Range()
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if r.String() != expected {
+			t.Errorf("%s read as %v, expected %s", source, r, expected)
+		}
+	}
+	// Integral bounds come back as int64 when integers are preferred.
+	vm.PreferIntegers(true)
+	value, err := vm.InterpretValue("2..5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := value.(*wren.Value).Range(); err != nil || r != (wren.Range{From: 2, To: 5, Inclusive: true}) {
+		t.Errorf("unexpected range with PreferIntegers: %v, %v", r, err)
+	}
+	vm.PreferIntegers(false)
+
+	value, err = vm.InterpretValue("Point.new()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := value.(*wren.Value).Range(); err == nil || err.Error() != "can't read a Point as a range" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for r, expected := range map[wren.Range][]int{
+		{From: -1, To: 1, Inclusive: true}: {-1, 0, 1},
+		{From: 1, To: 4}:                   {1, 2, 3},
+		{From: 4, To: 1}:                   {4, 3, 2},
+		{From: 2, To: 2}:                   {},
+		{From: 2, To: 2, Inclusive: true}:  {2},
+	} {
+		if ints, err := r.Ints(); err != nil || !reflect.DeepEqual(ints, expected) {
+			t.Errorf("%v expanded to %v, %v; expected %v", r, ints, err, expected)
+		}
+	}
+	for _, r := range []wren.Range{
+		{From: 0, To: 1.5, Inclusive: true},
+		{From: 0, To: math.Inf(1)},
+		{From: 0, To: wren.MaxRangeInts, Inclusive: true},
+		{From: 1e15, To: 0},
+	} {
+		if ints, err := r.Ints(); err == nil {
+			t.Errorf("expected %v to fail to expand, got %d numbers", r, len(ints))
+		}
+	}
+	if ints, err := (wren.Range{From: 0, To: wren.MaxRangeInts}).Ints(); err != nil || len(ints) != wren.MaxRangeInts {
+		t.Errorf("expected the largest range to expand, got %d numbers, %v", len(ints), err)
+	}
+}
+
+func TestForeignReturn(t *testing.T) {
+	type Widget struct {
+		size int
+	}
+	type Gadget struct {
+		name string
+	}
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignClass("Widget", func() interface{} {
+		return &Widget{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Widget.size", func(w *Widget) int {
+		return w.size
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignClassRef("Gadget", func() interface{} {
+		return &Gadget{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Gadget.name", func(g *Gadget) string {
+		return g.name
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Factory.widget(_)", func(size int) *Widget {
+		return &Widget{size: size}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Factory.gadget(_)", func(name string) interface{} {
+		return &Gadget{name: name}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Factory.nothing()", func() *Widget {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		foreign class Widget {
+			construct new() {}
+			foreign size
+		}
+		foreign class Gadget {
+			construct new() {}
+			foreign name
+		}
+		class Factory {
+			foreign static widget(size)
+			foreign static gadget(name)
+			foreign static nothing()
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]interface{}{
+		"Factory.widget(3) is Widget":  true,
+		"Factory.widget(3).size":       3.0,
+		`Factory.gadget("gizmo").name`: "gizmo",
+		"Factory.nothing()":            nil,
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignClass("Box", func() interface{} { return new(int) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Box.b()", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Box.a()", func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	methods := vm.RegisteredMethods()
+	if fmt.Sprint(methods) != "[Box.a() static Box.b()]" {
+		t.Errorf("unexpected methods: %v", methods)
+	}
+	methods[0] = "changed"
+	if vm.RegisteredMethods()[0] != "Box.a()" {
+		t.Error("RegisteredMethods returned an internal reference")
+	}
+
+	if classes := vm.RegisteredClasses(); fmt.Sprint(classes) != "[Box]" {
+		t.Errorf("unexpected classes: %v", classes)
+	}
+}
+
+func TestRegisterAll(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterAll(map[string]interface{}{
+		"static GoAll.add(_,_)": func(a, b int) int { return a + b },
+		"static GoAll.neg(_)":   func(a int) int { return -a },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if methods := vm.RegisteredMethods(); fmt.Sprint(methods) != "[static GoAll.add(_,_) static GoAll.neg(_)]" {
+		t.Errorf("unexpected methods: %v", methods)
+	}
+	value, err := vm.InterpretValue(`
+		class GoAll {
+			foreign static add(a, b)
+			foreign static neg(a)
+		}
+		GoAll.neg(GoAll.add(1, 2))
+	`)
+	if err != nil || value != -3.0 {
+		t.Errorf("unexpected result: %v, %v", value, err)
+	}
+
+	other := wren.NewVM()
+	defer other.Close()
+	err = other.RegisterAll(map[string]interface{}{
+		"static GoAll.add(_,_)": func(a, b int) int { return a + b },
+		"static GoAll.bad(_)":   "not a function",
+	})
+	if err == nil || !strings.Contains(err.Error(), "static GoAll.bad(_)") {
+		t.Errorf("expected an error naming the bad method, got %v", err)
+	}
+	if methods := other.RegisteredMethods(); len(methods) != 0 {
+		t.Errorf("expected nothing to be left registered, got %v", methods)
+	}
+
+	// A failed call leaves methods registered earlier under the same names alone.
+	err = vm.RegisterAll(map[string]interface{}{
+		"static GoAll.add(_,_)": func(a, b int) int { return a - b },
+		"static GoAll.bad(_)":   "not a function",
+	})
+	if err == nil {
+		t.Error("expected registering a bad method to fail")
+	}
+	if methods := vm.RegisteredMethods(); fmt.Sprint(methods) != "[static GoAll.add(_,_) static GoAll.neg(_)]" {
+		t.Errorf("unexpected methods after a failed call: %v", methods)
+	}
+	if value, err := vm.InterpretValue(`GoAll.add(1, 2)`); err != nil || value != 3.0 {
+		t.Errorf("unexpected result after a failed call: %v, %v", value, err)
+	}
+
+	// Registering over an existing name frees the slot it used.
+	for i := 0; i < wren.MAX_REGISTRATIONS*2; i++ {
+		if err := vm.RegisterAll(map[string]interface{}{
+			"static GoAll.neg(_)": func(a int) int { return -a },
+		}); err != nil {
+			t.Fatalf("registration %d failed: %v", i, err)
+		}
+		if err := vm.RegisterForeignMethodAliases(func() {}, "static GoAll.x()", "static GoAll.y()"); err != nil {
+			t.Fatalf("registration %d failed: %v", i, err)
+		}
+	}
+
+	// GoAll was declared with the old methods, so calling the replaced ones through
+	// it fails instead of reaching whatever took over their slots. Once the old class
+	// is gone, the new methods bind as usual.
+	if err := vm.RegisterAll(map[string]interface{}{
+		"static GoAll.add(_,_)": func(a, b int) int { return a - b },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoAll.neg(_)", func(a int) int { return a }); err != nil {
+		t.Fatal(err)
+	}
+	for expr, want := range map[string]string{
+		"GoAll.add(1, 2)": "static GoAll.add(_,_) is no longer registered",
+		"GoAll.neg(1)":    "static GoAll.neg(_) is no longer registered",
+	} {
+		value, err := vm.InterpretValue("Fiber.new { " + expr + " }.try()")
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+		} else if value != want {
+			t.Errorf("%s: expected %q, got %v", expr, want, value)
+		}
+	}
+	if err := vm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	value, err = vm.InterpretValue(`
+		class GoAll {
+			foreign static add(a, b)
+			foreign static neg(a)
+		}
+		GoAll.neg(GoAll.add(1, 2))
+	`)
+	if err != nil || value != -1.0 {
+		t.Errorf("unexpected result after a reset: %v, %v", value, err)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	// Registering and unregistering repeatedly shouldn't exhaust the pool.
+	for i := 0; i < wren.MAX_REGISTRATIONS*2; i++ {
+		if err := vm.RegisterForeignMethod("static GoGone.f()", func() {}); err != nil {
+			t.Fatalf("registration %d failed: %v", i, err)
+		}
+		vm.UnregisterForeignMethod("static GoGone.f()")
+	}
+
+	if err := vm.RegisterForeignClass("GoGoneClass", func() interface{} { return new(int) }); err != nil {
+		t.Fatal(err)
+	}
+	vm.UnregisterForeignClass("GoGoneClass")
+
+	if methods := vm.RegisteredMethods(); len(methods) != 0 {
+		t.Errorf("unexpected methods: %v", methods)
+	}
+	if classes := vm.RegisteredClasses(); len(classes) != 0 {
+		t.Errorf("unexpected classes: %v", classes)
+	}
+
+	if err := vm.Interpret(`
+		class GoGone {
+			foreign static f()
+		}
+	`); err == nil {
+		t.Error("expected binding of unregistered foreign method to fail")
+	}
+
+	// Classes declared before unregistering keep their bindings, which must fail
+	// cleanly instead of calling whatever else is registered since.
+	if err := vm.RegisterForeignMethod("static GoStale.f()", func() int { return 1 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignClass("GoStaleClass", func() interface{} { return new(int) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoStale {
+			foreign static f()
+		}
+		foreign class GoStaleClass {
+			construct new() {}
+		}
+		foreign class GoNeverRegistered {
+			construct new() {}
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	vm.UnregisterForeignMethod("static GoStale.f()")
+	vm.UnregisterForeignClass("GoStaleClass")
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("static GoOther.f%d()", i)
+		if err := vm.RegisterForeignMethod(name, func() int { return 2 }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for expr, want := range map[string]string{
+		"GoStale.f()":             "static GoStale.f() is no longer registered",
+		"GoStaleClass.new()":      "GoStaleClass is no longer registered",
+		"GoNeverRegistered.new()": "foreign class is not registered",
+	} {
+		value, err := vm.InterpretValue("Fiber.new { " + expr + " }.try()")
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+		} else if value != want {
+			t.Errorf("%s: expected %q, got %v", expr, want, value)
+		}
+	}
+}
+
+func TestForeignMethodAliases(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	if err := vm.RegisterForeignMethodAliases(func(a, b float64) float64 {
+		return a + b
+	}, "static Calc.add(_,_)", "static Calc.plus(_,_)", "static Sum.of(_,_)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethodAliases(func() {}); err == nil {
+		t.Error("expected registering without names to fail")
+	}
+
+	// The names share a single slot, so there can be far more of them than slots.
+	names := make([]string, wren.MAX_REGISTRATIONS*2)
+	for i := range names {
+		names[i] = fmt.Sprintf("static Many.f%d()", i)
+	}
+	if err := vm.RegisterForeignMethodAliases(func() {}, names...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class Calc {
+			foreign static add(a, b)
+			foreign static plus(a, b)
+		}
+		class Sum {
+			foreign static of(a, b)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	value, err := vm.InterpretValue("Calc.add(1, 2) + Calc.plus(3, 4) + Sum.of(5, 6)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 21.0 {
+		t.Errorf("unexpected result: %v", value)
+	}
+
+	// Unregistering one name leaves the others working.
+	vm.UnregisterForeignMethod("static Calc.add(_,_)")
+	vm.UnregisterForeignMethod("static Calc.plus(_,_)")
+	for _, name := range vm.RegisteredMethods() {
+		if strings.HasPrefix(name, "static Calc.") {
+			t.Errorf("%s is still registered", name)
+		}
+	}
+	value, err = vm.InterpretValue("Sum.of(5, 6)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 11.0 {
+		t.Errorf("unexpected result: %v", value)
+	}
+}
+
+func TestDebugBindMiss(t *testing.T) {
+	var buf bytes.Buffer
+	wren.SetErrorWriter(&buf)
+	defer wren.SetErrorWriter(nil)
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetDebug(true)
+	if err := vm.RegisterForeignMethod("static GoDebug.add(_,_)", func(a, b int) int {
+		return a + b
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoDebug {
+			foreign static add(x)
+		}
+	`); err == nil {
+		t.Error("expected binding of unregistered foreign method to fail")
+	}
+
+	if !strings.Contains(buf.String(), `"static GoDebug.add(_)"`) {
+		t.Errorf("debug output is missing the looked-up name: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "static GoDebug.add(_,_)") {
+		t.Errorf("debug output is missing the registered names: %s", buf.String())
+	}
+}
+
+func TestDebugPanicStack(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoPanic.now()", func() {
+		panic("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoPanic {
+			foreign static now()
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	const source = "Fiber.new { GoPanic.now() }.try()"
+	value, err := vm.InterpretValue(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "boom" {
+		t.Errorf("unexpected error outside of debug mode: %q", value)
+	}
+
+	vm.SetDebug(true)
+	value, err = vm.InterpretValue(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := value.(string); !strings.HasPrefix(msg, "boom\n\ngoroutine ") || !strings.Contains(msg, "TestDebugPanicStack") {
+		t.Errorf("expected a stack trace in debug mode, got %q", value)
+	}
+}
+
+func TestClock(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+
+	now := 42.0
+	if err := vm.SetClock(func() float64 { return now }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class Go {
+			foreign static clock
+		}
+
+		System.print(Go.clock)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	now = 43.5
+	if err := vm.Interpret(`System.print(Go.clock)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "42\n43.5\n" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestCallWren(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class WrenMath {
+			static do_add(a, b) {
+				return a + b
+			}
+		}
+	`); err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+
+	x, err := vm.Variable("WrenMath").Call("do_add(_,_)", 2, 3)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	n, ok := x.(float64)
+	if !ok {
+		t.Logf("WrenMath.add(2, 3) returned unexpected value: %v", x)
+		t.FailNow()
+	}
+
+	if n != 5 {
+		t.Errorf("WrenMath.add(2, 3) returned unexpected value: %v", x)
+	}
+}
+
+func TestCallReturnsLongStrings(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoStrings.echo(_)", func(s string) string {
+		return s
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`
+		class GoStrings {
+			foreign static echo(s)
+			static repeat(s, n) { "<%(s * n)>" }
+			static withNul(s) { "%(s)\0%(s)" }
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	class := vm.Variable("GoStrings")
+
+	x, err := class.Call("repeat(_,_)", "wren", 1<<18)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<" + strings.Repeat("wren", 1<<18) + ">"; x != expected {
+		t.Errorf("unexpected result of length %d, expected length %d", len(fmt.Sprint(x)), len(expected))
+	}
+
+	x, err = class.Call("withNul(_)", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != "a\x00a" {
+		t.Errorf("unexpected result: %q", x)
+	}
+
+	// Strings with NUL bytes survive the trip through a foreign method too.
+	x, err = class.Call("echo(_)", "b\x00b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != "b\x00b" {
+		t.Errorf("unexpected result: %q", x)
+	}
+}
+
+func TestFloatSliceReturn(t *testing.T) {
+	type Series []float64
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoSeries.plain()", func() []float64 {
+		return []float64{1.5, -2, math.Inf(1)}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoSeries.named()", func() Series {
+		return Series{3, 4}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static GoSeries.empty()", func() []float64 {
+		return []float64{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoSeries {
+			foreign static plain()
+			foreign static named()
+			foreign static empty()
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for source, expected := range map[string]interface{}{
+		"GoSeries.plain().toString":               "[1.5, -2, infinity]",
+		"GoSeries.named().reduce {|a, b| a * b }": 12.0,
+		"GoSeries.empty().count":                  0.0,
+		"GoSeries.plain().add(7)[-1]":             7.0,
+	} {
+		value, err := vm.InterpretValue(source)
+		if err != nil {
+			t.Errorf("%s failed: %v", source, err)
+		} else if value != expected {
+			t.Errorf("%s returned %v, expected %v", source, value, expected)
+		}
+	}
+}
+
+func TestPreferIntegers(t *testing.T) {
+	var got interface{}
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoNum.take(_)", func(x interface{}) {
+		got = x
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoNum {
+			foreign static take(x)
+			static half(n) { n / 2 }
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	class := vm.Variable("GoNum")
+
+	x, err := class.Call("half(_)", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != 5.0 {
+		t.Errorf("expected float64 results by default, got %T %v", x, x)
+	}
+
+	vm.PreferIntegers(true)
+	for n, expected := range map[float64]interface{}{
+		10:          int64(5),
+		-4:          int64(-2),
+		5:           2.5,
+		1 << 60:     float64(1 << 59),
+		math.Inf(1): math.Inf(1),
+	} {
+		x, err := class.Call("half(_)", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x != expected {
+			t.Errorf("half(%v) returned %T %v, expected %T %v", n, x, x, expected, expected)
+		}
+	}
+
+	if _, err := vm.InterpretValue(`GoNum.take([1, 1.5])`); err != nil {
+		t.Fatal(err)
+	}
+	if list, ok := got.([]interface{}); !ok || len(list) != 2 || list[0] != int64(1) || list[1] != 1.5 {
+		t.Errorf("unexpected list: %#v", got)
+	}
+}
+
+func TestCallReturnsObject(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class Point {
+			construct new(x, y) {
+				_x = x
+				_y = y
+			}
+
+			x { _x }
+			y { _y }
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := vm.Variable("Point").Call("new(_,_)", 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point, ok := x.(*wren.Value)
+	if !ok {
+		t.Fatalf("Point.new(3, 4) returned unexpected value: %v", x)
+	}
+
+	if y, err := point.Call("y"); err != nil || y != 4.0 {
+		t.Errorf("point.y returned unexpected value: %v, %v", y, err)
+	}
+}
+
+func TestCallWithValue(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class Point {
+			construct new(x, y) {
+				_x = x
+				_y = y
+			}
+
+			x { _x }
+			y { _y }
+
+			+(other) { Point.new(_x + other.x, _y + other.y) }
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	class := vm.Variable("Point")
+	a, err := class.CallValue("new(_,_)", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := class.CallValue("new(_,_)", 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := a.CallValue("+(_)", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if y, err := sum.Call("y"); err != nil || y != 22.0 {
+		t.Errorf("(a + b).y returned unexpected value: %v, %v", y, err)
+	}
+}
+
+func TestCallArgumentCount(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.Interpret(`
+		class Args {
+			static count(a, b) { 2 }
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	class := vm.Variable("Args")
+
+	huge := make([]interface{}, 1<<20)
+	if _, err := class.Call("count(_,_)", huge...); err == nil {
+		t.Error("expected an oversized params slice to be rejected")
+	}
+	if _, err := class.Call("count(_,_)", 1); err == nil {
+		t.Error("expected too few params to be rejected")
+	}
+	if _, err := vm.MakeCallHandle("count(_,_)").Call(class, 1, 2, 3); err == nil {
+		t.Error("expected too many params to be rejected by a call handle")
+	}
+	if n, err := class.Call("count(_,_)", 1, 2); err != nil || n != 2.0 {
+		t.Errorf("unexpected result: %v, %v", n, err)
+	}
+}
+
+func TestStrictArity(t *testing.T) {
+	type Counter struct {
+		N float64
+	}
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignClass("Counter", func() interface{} { return Counter{} }); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("Counter.add(_)", func(c *Counter, n float64) float64 {
+		c.N += n
+		return c.N
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Calc.add(_,_)", func(a, b float64) float64 {
+		return a + b
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignMethod("static Calc.first(_,_)", func(a float64) float64 {
+		return a
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		foreign class Counter {
+			construct new() {}
+			foreign add(n)
+		}
+
+		class Calc {
+			foreign static add(a, b)
+			foreign static first(a, b)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strict := range []bool{false, true} {
+		vm.StrictArity(strict)
+		expectedFirst := interface{}(1.0)
+		if strict {
+			expectedFirst = "foreign method takes 1 arguments, but was given 2"
+		}
+		for source, expected := range map[string]interface{}{
+			"Counter.new().add(2)":                 2.0,
+			"Calc.add(1, 2)":                       3.0,
+			"Fiber.new { Calc.first(1, 2) }.try()": expectedFirst,
+		} {
+			value, err := vm.InterpretValue(source)
+			if err != nil {
+				t.Errorf("%s failed: %v", source, err)
+			} else if value != expected {
+				t.Errorf("%s returned %v with strict=%t, expected %v", source, value, strict, expected)
+			}
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class Box {
+			construct new(x) {
+				_x = x
+			}
+			x { _x }
+			max_value { _x * 10 }
+			twice() { _x * 2 }
+		}
+		var box = Box.new(4)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	box := vm.Variable("box")
+	if x, err := box.Get("x"); err != nil || x != 4.0 {
+		t.Errorf("box.x returned %v, %v", x, err)
+	}
+	if x, err := box.Get("max_value"); err != nil || x != 40.0 {
+		t.Errorf("box.max_value returned %v, %v", x, err)
+	}
+	if x, err := box.Call("twice()"); err != nil || x != 8.0 {
+		t.Errorf("box.twice() returned %v, %v", x, err)
+	}
+	if _, err := box.Get("twice()"); err == nil {
+		t.Error("expected Get to reject a method signature")
+	}
+}
+
+func TestListIteration(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		var squares = (0...1000).map {|i| i * i }.toList
+		var notList = "nope"
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	squares := vm.Variable("squares")
+	n := squares.ListLen()
+	if n != 1000 {
+		t.Fatalf("ListLen returned %d", n)
+	}
+	for i := 0; i < n; i++ {
+		x, err := squares.ListAt(i)
+		if err != nil || x != float64(i*i) {
+			t.Fatalf("ListAt(%d) returned %v, %v", i, x, err)
+		}
+	}
+
+	if _, err := squares.ListAt(n); err == nil {
+		t.Error("expected an error for an index out of range")
+	}
+	notList := vm.Variable("notList")
+	if notList.ListLen() != 0 {
+		t.Error("expected ListLen of a string to be 0")
+	}
+	if _, err := notList.ListAt(0); err == nil {
+		t.Error("expected an error for ListAt on a string")
+	}
+}
+
+func TestStaticGetter(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class Settings {
+			static name { __name }
+			static name=(value) { __name = value }
+			static count { __count }
+			static bump(n) {
+				if (__count == null) __count = 0
+				__count = __count + n
+			}
+		}
+		Settings.name = "demo"
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := vm.Variable("Settings")
+	if name, err := settings.Get("name"); err != nil || name != "demo" {
+		t.Errorf("Settings.name returned %v, %v", name, err)
+	}
+	if count, err := settings.Get("count"); err != nil || count != nil {
+		t.Errorf("Settings.count returned %v, %v before being set", count, err)
+	}
+	if _, err := settings.Call("bump(_)", 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.Call("name=(_)", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := settings.Get("count"); err != nil || count != 3.0 {
+		t.Errorf("Settings.count returned %v, %v", count, err)
+	}
+	if name, err := settings.Get("name"); err != nil || name != "changed" {
+		t.Errorf("Settings.name returned %v, %v", name, err)
+	}
+}
+
+func TestCallValue(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class Counter {
+			construct new(n) {
+				_n = n
+			}
+
+			next { Counter.new(_n + 1) }
+			n { _n }
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	counter, err := vm.Variable("Counter").CallValue("new(_)", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter, err = counter.CallValue("next"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := counter.CallValue("n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := n.Call("toString"); err != nil || s != "2" {
+		t.Errorf("counter.next.n.toString returned unexpected value: %v, %v", s, err)
+	}
+}
+
+func TestCallHandle(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class Counter {
+			construct new(n) {
+				_n = n
+			}
+
+			add(x) { _n + x }
+		}
+		var a = Counter.new(1)
+		var b = Counter.new(10)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	add := vm.MakeCallHandle("add(_)")
+	for name, expected := range map[string]float64{"a": 3, "b": 12} {
+		if n, err := add.Call(vm.Variable(name), 2); err != nil || n != expected {
+			t.Errorf("%s.add(2) returned %v, %v; expected %v", name, n, err, expected)
+		}
+	}
+	if _, err := add.Call(nil, 2); err != wren.ErrNoReceiver {
+		t.Errorf("expected calling without a receiver to fail, got %v", err)
+	}
+	if _, err := add.Call(vm.Variable("a"), 1+2i); err == nil {
+		t.Error("expected calling with an unsupported parameter to fail")
+	}
+	if n, err := add.Call(vm.Variable("a"), 2); err != nil || n != 3.0 {
+		t.Errorf("a.add(2) returned %v, %v after a failed call", n, err)
+	}
+
+	add.Release()
+	add.Release()
+	if _, err := add.Call(vm.Variable("a"), 2); err != wren.ErrReleased {
+		t.Errorf("expected a released handle to fail, got %v", err)
+	}
+
+	a := vm.Variable("a")
+	vm.ReleaseValue(a)
+	if _, err := a.Call("add(_)", 2); err != wren.ErrReleased {
+		t.Errorf("expected a released value to fail, got %v", err)
+	}
+}
+
+func TestValueEquality(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class Point {
+			construct new(x) {
+				_x = x
+			}
+			x { _x }
+			==(other) { other is Point && other.x == _x }
+		}
+		var a = Point.new(1)
+		var b = Point.new(1)
+		var c = Point.new(2)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b, c := vm.Variable("a"), vm.Variable("b"), vm.Variable("c")
+	for _, test := range []struct {
+		x, y        *wren.Value
+		equal, same bool
+	}{
+		{a, b, true, false},
+		{a, c, false, false},
+		{a, vm.Variable("a"), true, true},
+	} {
+		if equal, err := test.x.Equals(test.y); err != nil || equal != test.equal {
+			t.Errorf("Equals returned %v, %v; expected %v", equal, err, test.equal)
+		}
+		if same := test.x.Same(test.y); same != test.same {
+			t.Errorf("Same returned %v, expected %v", same, test.same)
+		}
+	}
+
+	// Comparing values mustn't leave anything behind each time.
+	before := vm.BytesAllocated()
+	for i := 0; i < 1000; i++ {
+		a.Same(b)
+	}
+	if grown := vm.BytesAllocated() - before; grown > 1000 {
+		t.Errorf("memory grew by %d bytes while comparing values", grown)
+	}
+
+	// Nor does it need the main module, or break when it's replaced.
+	if err := vm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.InterpretBytes("lib", []byte("var x = []")); err != nil {
+		t.Fatal(err)
+	}
+	x, err := vm.VariableFrom("lib", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := vm.VariableFrom("lib", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !x.Same(y) {
+		t.Error("expected separate handles to the same list to be the same after a reset")
+	}
+}
+
+func TestClassName(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.Interpret(`
+		class Point {
+			construct new() {}
+		}
+		var point = Point.new()
+		var list = [1, 2]
+		var text = "hi"
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"point": "Point",
+		"list":  "List",
+		"text":  "String",
+		"Point": "Point metaclass",
+	} {
+		if className, err := vm.Variable(name).ClassName(); err != nil || className != expected {
+			t.Errorf("class of %s: got %q, %v; expected %q", name, className, err, expected)
+		}
+	}
+}
+
+func TestValueType(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignClass("Handle", func() interface{} { return 0 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		foreign class Handle {
+			construct new() {}
+		}
+		class Point {
+			construct new() {}
+		}
+		var point = Point.new()
+		var handle = Handle.new()
+		var list = [1, 2]
+		var map = {"a": 1}
+		var text = "hi"
+		var number = 3
+		var flag = true
+		var nothing = null
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]wren.Type{
+		"point":   wren.TypeUnknown,
+		"handle":  wren.TypeForeign,
+		"list":    wren.TypeList,
+		"map":     wren.TypeMap,
+		"text":    wren.TypeString,
+		"number":  wren.TypeNum,
+		"flag":    wren.TypeBool,
+		"nothing": wren.TypeNull,
+	} {
+		if typ := vm.Variable(name).Type(); typ != expected {
+			t.Errorf("type of %s: got %v, expected %v", name, typ, expected)
+		}
+	}
+
+	list := vm.Variable("list")
+	vm.ReleaseValue(list)
+	if typ := list.Type(); typ != wren.TypeUnknown {
+		t.Errorf("type of released value: got %v", typ)
+	}
+}
+
+func TestValueString(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class Point {
+			construct new(x, y) {
+				_x = x
+				_y = y
+			}
+			toString { "(%(_x), %(_y))" }
+		}
+		class Broken {
+			construct new() {}
+			toString { Fiber.abort("no") }
+		}
+		var p = Point.new(1, 2)
+		var b = Broken.new()
+		var l = [1, "two"]
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	for name, expected := range map[string]string{
+		"p": "(1, 2)",
+		"b": "<wren value>",
+		"l": "[1, two]",
+	} {
+		if s := fmt.Sprint(vm.Variable(name)); s != expected {
+			t.Errorf("%s printed as %q, expected %q", name, s, expected)
+		}
+	}
+}
+
+func TestCallReturnsContainers(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class Data {
+			static list { [1, 2, 3] }
+			static map { {"a": 1} }
+			static nested { {"xs": [true, null, {1: "one"}]} }
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	data := vm.Variable("Data")
+	for signature, expected := range map[string]string{
+		"list":   "[1 2 3]",
+		"map":    "map[a:1]",
+		"nested": "map[xs:[true <nil> map[1:one]]]",
+	} {
+		value, err := data.Call(signature)
+		if err != nil {
+			t.Errorf("%s failed: %v", signature, err)
+		} else if fmt.Sprint(value) != expected {
+			t.Errorf("%s returned %v, expected %s", signature, value, expected)
+		}
+	}
+
+	value, _ := data.Call("list")
+	if list, ok := value.([]interface{}); !ok || len(list) != 3 || list[0] != 1.0 {
+		t.Errorf("list returned unexpected value: %#v", value)
+	}
+	value, _ = data.Call("map")
+	if m, ok := value.(map[interface{}]interface{}); !ok || m["a"] != 1.0 {
+		t.Errorf("map returned unexpected value: %#v", value)
+	}
+
+	// Containers holding themselves can't be converted, and fail the call rather
+	// than recursing until the stack runs out.
+	if err := vm.Interpret(`
+		class Cycles {
+			static map {
+				var m = {}
+				m["self"] = m
+				return m
+			}
+			static list {
+				var l = [1]
+				l.add({"l": l})
+				return l
+			}
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	cycles := vm.Variable("Cycles")
+	for _, signature := range []string{"map", "list"} {
+		if value, err := cycles.Call(signature); err == nil || !strings.Contains(err.Error(), "may contain itself") {
+			t.Errorf("%s returned %v, %v; expected an error", signature, value, err)
+		}
+	}
+	if value, err := data.Call("nested"); err != nil || value == nil {
+		t.Errorf("converting after a failure returned %v, %v", value, err)
+	}
+}
+
+func TestLoadModule(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetModulesDir("testdata/modules")
+
+	if err := vm.Interpret(`import "hello" for Hello
+		Hello.world()`); err != nil {
+		t.Log("module load error: ", err)
+		t.FailNow()
+	}
+}
+
+func BenchmarkInterpret(b *testing.B) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := vm.Interpret(`{ var x = 1 + 2 }`); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCall(b *testing.B) {
+	vm := wren.NewVM()
+	defer vm.Close()
+
+	if err := vm.Interpret(`
+		class WrenMath {
+			static add(a, b) { a + b }
+		}
+	`); err != nil {
+		b.Fatal(err)
+	}
+	class := vm.Variable("WrenMath")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := class.Call("add(_,_)", i, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFloatSlice(b *testing.B) {
+	const size = 1000000
+	var (
+		floats     = make([]float64, size)
+		interfaces = make([]interface{}, size)
+	)
+	for i := range floats {
+		floats[i] = float64(i)
+		interfaces[i] = float64(i)
+	}
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static Series.floats()", func() []float64 { return floats }); err != nil {
+		b.Fatal(err)
+	}
+	// The same numbers as []interface{} take the path used for all other lists,
+	// saving each element through reflection.
+	if err := vm.RegisterForeignMethod("static Series.interfaces()", func() []interface{} { return interfaces }); err != nil {
+		b.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class Series {
+			foreign static floats()
+			foreign static interfaces()
+		}
+	`); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, name := range []string{"floats", "interfaces"} {
+		b.Run(name, func(b *testing.B) {
+			source := fmt.Sprintf("Series.%s().count", name)
+			b.SetBytes(size * 8)
+			for i := 0; i < b.N; i++ {
+				if err := vm.Interpret(source); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStringRoundTrip(b *testing.B) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.RegisterForeignMethod("static GoStrings.echo(_)", func(s string) string { return s }); err != nil {
+		b.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class GoStrings {
+			foreign static echo(s)
+			static roundTrip(s) { echo(s) }
+		}
+	`); err != nil {
+		b.Fatal(err)
+	}
+	class := vm.Variable("GoStrings")
+
+	for _, size := range []int{16, 1 << 10, 1 << 20} {
+		s := strings.Repeat("w", size)
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := class.Call("roundTrip(_)", s); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestImported(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetModulesDir("testdata/modules")
+	vm.SetOutputWriter(ioutil.Discard)
+
+	if err := vm.Interpret(`import "hello" for Hello`); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := vm.Imported("hello", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := values["Hello"].Call("world()"); err != nil {
+		t.Error(err)
+	}
+
+	// The imported name is also a variable of the importing module.
+	if _, err := vm.VariableFrom("main", "Hello"); err != nil {
+		t.Error(err)
+	}
+	if _, err := vm.VariableFrom("hello", "Goodbye"); err == nil {
+		t.Error("expected an error for a missing variable")
+	}
+	if _, err := vm.Imported("goodbye", "Hello"); err == nil {
+		t.Error("expected an error for a missing module")
+	}
+}
+
+func TestSetVariable(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	if err := vm.Interpret(`
+		var limit = 1
+		var names = null
+		class Report {
+			static print() { System.print("%(limit) %(names)") }
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.SetVariable("main", "limit", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetVariable("main", "names", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`Report.print()`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "10 [a, b]\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+
+	for _, c := range []struct{ module, name string }{
+		{"main", "missing"},
+		{"missing", "limit"},
+	} {
+		if err := vm.SetVariable(c.module, c.name, 1); err == nil {
+			t.Errorf("expected setting %s in %s to fail", c.name, c.module)
+		}
+	}
+	var unsupported *wren.UnsupportedTypeError
+	if err := vm.SetVariable("main", "limit", make(chan int)); !errors.As(err, &unsupported) {
+		t.Errorf("expected an UnsupportedTypeError, got %v", err)
+	}
+
+	// Setting a variable runs nothing through the source transform, and leaves nothing
+	// behind, even in other modules.
+	vm.SetSourceTransform(func(module, source string) string {
+		return source + "\nSystem.print(\"transformed\")"
+	})
+	if err := vm.InterpretBytes("settings", []byte("var value = 1")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := vm.SetVariable("settings", "value", "two"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+	if value, err := vm.VariableFrom("settings", "value"); err != nil || value.String() != "two" {
+		t.Errorf("variable wasn't set: %v, %v", value, err)
+	}
+	if _, err := vm.VariableFrom("settings", "GoResult"); err == nil {
+		t.Error("SetVariable left a variable behind")
+	}
+}
+
+func TestCloseThenGC(t *testing.T) {
+	vm := wren.NewVM()
+	if err := vm.Interpret(`var x = [1, 2, 3]`); err != nil {
+		t.Fatal(err)
+	}
+	x := vm.Variable("x")
+	call := vm.MakeCallHandle("count")
+
+	vm.Close()
+	vm.Close()
+
+	// Neither the handles nor the VM itself should be freed a second time when
+	// they're collected, and everything belonging to the VM reports that it's
+	// been closed.
+	runtime.GC()
+	runtime.GC()
+	if _, err := x.Call("count"); err != wren.ErrClosed {
+		t.Errorf("calling a value of a closed VM returned %v", err)
+	}
+	if _, err := call.Call(x); err != wren.ErrClosed {
+		t.Errorf("calling a handle of a closed VM returned %v", err)
+	}
+	if err := vm.Interpret(`System.print("closed")`); err != wren.ErrClosed {
+		t.Errorf("interpreting on a closed VM returned %v", err)
+	}
+	if _, err := vm.InterpretValue(`1 + 2`); err != wren.ErrClosed {
+		t.Errorf("InterpretValue on a closed VM returned %v", err)
+	}
+	if err := vm.InterpretContext(context.Background(), `1 + 2`); err != wren.ErrClosed {
+		t.Errorf("InterpretContext on a closed VM returned %v", err)
+	}
+	vm.ReleaseValue(x)
+	call.Release()
+	runtime.GC()
+}
+
+func TestCloseReleasesEverything(t *testing.T) {
+	var (
+		staleClass  *wren.Value
+		staleHandle *wren.CallHandle
+	)
+	// Without Close giving back registrations, this would run out of them.
+	for i := 0; i < 300; i++ {
+		vm := wren.NewVM()
+		// The new virtual machine may be allocated where the last one was freed,
+		// which mustn't make the last one's values usable again.
+		if staleClass != nil {
+			if _, err := staleClass.Call("id(_)", i); err != wren.ErrClosed {
+				t.Fatalf("iteration %d: expected a value of a closed VM to fail, got %v", i, err)
+			}
+			if _, err := staleHandle.Call(staleClass, i); err != wren.ErrClosed {
+				t.Fatalf("iteration %d: expected a call handle of a closed VM to fail, got %v", i, err)
+			}
+		}
+		if err := vm.RegisterForeignMethod("static GoClose.id(_)", func(n int) int {
+			return n
+		}); err != nil {
+			t.Fatalf("iteration %d: %v", i, err)
+		}
+		if err := vm.Interpret(`
+			class GoClose {
+				foreign static id(n)
+			}
+			var list = [1, 2, 3]
+		`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Leave handles outstanding for Close to release.
+		class := vm.Variable("GoClose")
+		if n, err := class.Call("id(_)", i); err != nil || n != float64(i) {
+			t.Fatalf("unexpected result: %v, %v", n, err)
+		}
+		handle := vm.MakeCallHandle("id(_)")
+		vm.Variable("list")
+
+		vm.Close()
+		if _, err := class.Call("id(_)", i); err != wren.ErrClosed {
+			t.Fatalf("expected a value of a closed VM to fail, got %v", err)
+		}
+		staleClass, staleHandle = class, handle
+	}
+	staleClass, staleHandle = nil, nil
+	runtime.GC()
+	runtime.GC()
+}
+
+func TestSandboxVM(t *testing.T) {
+	vm := wren.NewSandboxVM()
+	vm.SetModulesDir("testdata/modules")
+	if err := vm.RegisterForeignMethod("static Allowed.answer()", func() int {
+		return 42
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+	if err := vm.Interpret(`import "hello" for Hello`); err == nil {
+		t.Error("sandboxed script imported a module")
+	}
+
+	value, err := vm.InterpretValue(`
+		class Allowed {
+			foreign static answer()
+		}
+		Allowed.answer()
+	`)
+	if err != nil || value != 42.0 {
+		t.Errorf("registered method returned %v, %v", value, err)
+	}
+}
+
+func TestModuleFS(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	vm.SetModulesDir("testdata/modules")
+	vm.SetModuleFS(fstest.MapFS{
+		"greet.wren":           {Data: []byte(`class Greet { static hi() { System.print("hi") } }`)},
+		"farewell/module.wren": {Data: []byte(`class Farewell { static bye() { System.print("bye") } }`)},
+	})
+
+	if err := vm.Interpret(`
+		import "greet" for Greet
+		import "farewell" for Farewell
+		import "hello" for Hello
+
+		Greet.hi()
+		Farewell.bye()
+		Hello.world()
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hi\nbye\nHello World from Wren\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestSourceTransform(t *testing.T) {
+	var buf bytes.Buffer
+	var modules []string
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	vm.SetModuleFS(fstest.MapFS{
+		"shout.wren": {Data: []byte(`class Shout { static it(s) { System.print(Prelude.loud(s)) } }`)},
+	})
+	vm.SetSourceTransform(func(module, source string) string {
+		modules = append(modules, module)
+		return "class Prelude { static loud(s) { s + \"!\" } }\n" + source
+	})
+
+	if err := vm.Interpret(`
+		import "shout" for Shout
+		Shout.it("imported")
+		System.print(Prelude.loud("main"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "imported!\nmain!\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+	if fmt.Sprint(modules) != "[main shout]" {
+		t.Errorf("unexpected modules transformed: %v", modules)
+	}
+
+	vm.SetSourceTransform(nil)
+	if err := vm.Interpret(`var unchanged = true`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepSources(t *testing.T) {
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetModuleFS(fstest.MapFS{
+		"checker.wren": {Data: []byte("class Checker {\n  static check(n) {\n    if (n < 0) Fiber.abort(\"negative\")\n  }\n}\n")},
+	})
+	source := "import \"checker\" for Checker\nChecker.check(-1)\n"
+
+	// By default, runtime errors carry no details.
+	if err := vm.Interpret(`Fiber.abort("oops")`); err != wren.ErrRuntime {
+		t.Fatalf("expected ErrRuntime, got %v", err)
+	}
+
+	vm.KeepSources(true)
+	err := vm.Interpret(source)
+	var runtimeErr *wren.RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected a *RuntimeError, got %v", err)
+	}
+	if !errors.Is(err, wren.ErrRuntime) || err.Error() != "runtime error: negative" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(runtimeErr.Frames) != 2 {
+		t.Fatalf("expected 2 frames, got %+v", runtimeErr.Frames)
+	}
+	for i, expected := range []wren.StackFrame{
+		{Module: "checker", Line: 3, Source: `    if (n < 0) Fiber.abort("negative")`},
+		{Module: "main", Line: 2, Function: "(script)", Source: "Checker.check(-1)"},
+	} {
+		frame := runtimeErr.Frames[i]
+		if expected.Function == "" {
+			expected.Function = frame.Function
+		}
+		if frame != expected {
+			t.Errorf("frame %d: got %+v, expected %+v", i, frame, expected)
+		}
+	}
+}
+
+func TestInterpretNamed(t *testing.T) {
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	vm.KeepSources(true)
+
+	err := vm.InterpretNamed("gen/app.ts", "var x = 1\nvar y = )\n")
+	var compileErr *wren.CompileError
+	if !errors.As(err, &compileErr) || compileErr.Module != "gen/app.ts" || compileErr.Source != "var y = )" {
+		t.Errorf("unexpected compile error: %#v", err)
+	}
+
+	err = vm.InterpretNamed("gen/lib.ts", "class Lib {\n  static fail() { Fiber.abort(\"nope\") }\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vm.InterpretNamed("gen/main.ts", "import \"gen/lib.ts\" for Lib\nSystem.print(\"start\")\nLib.fail()\n")
+	var runtimeErr *wren.RuntimeError
+	if !errors.As(err, &runtimeErr) || len(runtimeErr.Frames) != 2 {
+		t.Fatalf("unexpected runtime error: %#v", err)
+	}
+	for i, expected := range []string{"gen/lib.ts:2", "gen/main.ts:3"} {
+		if frame := runtimeErr.Frames[i]; fmt.Sprintf("%s:%d", frame.Module, frame.Line) != expected {
+			t.Errorf("frame %d: got %+v, expected %s", i, frame, expected)
+		}
+	}
+	if buf.String() != "start\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestInterpretNamedForeign(t *testing.T) {
+	type Point struct{ X float64 }
+
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	if err := vm.RegisterAll(map[string]interface{}{
+		"static Geo.double(_)": func(x float64) float64 { return x * 2 },
+		"static Geo.origin()":  func() Point { return Point{X: 1} },
+		"Point.x":              func(p Point) float64 { return p.X },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RegisterForeignClass("Point", func() interface{} { return Point{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.InterpretNamed("gen/geo.ts", `
+		class Geo {
+			foreign static double(x)
+			foreign static origin()
+		}
+		foreign class Point {
+			construct new() {}
+			foreign x
+		}
+		System.print(Geo.double(21))
+		System.print(Point.new().x)
+		System.print(Geo.origin().x)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		import "gen/geo.ts" for Geo
+		System.print(Geo.origin().x + Geo.double(2))
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "42\n0\n1\n5\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestFlush(t *testing.T) {
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	var (
+		buf  bytes.Buffer
+		seen string
+	)
+	w := bufio.NewWriterSize(&buf, 4096)
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(w)
+	if err := vm.RegisterForeignMethod("static GoFlush.check()", func(vm *wren.VM) error {
+		if buf.Len() != 0 {
+			return fmt.Errorf("output was flushed early: %q", buf.String())
+		}
+		if err := vm.Flush(); err != nil {
+			return err
+		}
+		seen = buf.String()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := vm.Interpret(`
+		class GoFlush {
+			foreign static check()
+		}
+		System.print("before")
+		GoFlush.check()
+		System.print("after")
+		Fiber.abort("failed")
+		System.print("never")
+	`)
+	if !errors.Is(err, wren.ErrRuntime) {
+		t.Fatalf("expected a runtime error, got %v", err)
+	}
+	if seen != "before\n" {
+		t.Errorf("Flush wrote %q", seen)
+	}
+	// The rest of the output is flushed when the script fails.
+	if buf.String() != "before\nafter\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestValidateUTF8(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	const source = "System.print(\"ok\")\nSystem.print(\"\xff\")\n"
+
+	// Without validation, the bytes go straight through.
+	if err := vm.Interpret(source); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "ok\n\xff\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+
+	buf.Reset()
+	vm.ValidateUTF8(true)
+	vm.SetDisplayName("script.wren")
+	err := vm.Interpret(source)
+	if !errors.Is(err, wren.ErrInvalidUTF8) || err.Error() != "source is not valid UTF-8: script.wren:2" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("invalid source was run: %q", buf.String())
+	}
+	if err := vm.Interpret(`System.print("héllo")`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCircularImport(t *testing.T) {
+	var messages []string
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetErrorFunc(func(errType, module string, line int, msg string) {
+		if errType == wren.ErrorTypeRuntime {
+			messages = append(messages, msg)
+		}
+	})
+	vm.SetModuleFS(fstest.MapFS{
+		"a.wren":      {Data: []byte(`import "b" for B` + "\n" + `class A {}`)},
+		"b.wren":      {Data: []byte(`import "c" for C` + "\n" + `class B {}`)},
+		"c.wren":      {Data: []byte(`import "a" for A` + "\n" + `class C {}`)},
+		"shared.wren": {Data: []byte(`class Shared {}`)},
+		"user.wren":   {Data: []byte(`import "shared" for Shared`)},
+		"lib.wren":    {Data: []byte(`import "util"`)},
+		"util.wren":   {Data: []byte(`class Util {}`)},
+	})
+
+	// Importing the same module from several places is fine.
+	if err := vm.Interpret(`
+		import "shared" for Shared
+		import "user"
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.Interpret(`import "a" for A`); err == nil {
+		t.Fatal("expected circular import to fail")
+	}
+	// The cycle is reported once, rather than again as a module Wren couldn't resolve.
+	if len(messages) != 1 || messages[0] != "circular import: a -> b -> c -> a" {
+		t.Errorf("unexpected error messages: %q", messages)
+	}
+
+	// Which module imported which is forgotten between runs, so importing a module
+	// that's already loaded isn't mistaken for a cycle.
+	if err := vm.Interpret(`import "lib"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.InterpretBytes("util", []byte(`import "lib"`)); err != nil {
+		t.Errorf("importing a loaded module failed: %v", err)
+	}
+}
+
+func TestMaxImportDepth(t *testing.T) {
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	modules := fstest.MapFS{
+		"a.wren": {Data: []byte(`import "b" for B` + "\n" + `class A {}`)},
+		"b.wren": {Data: []byte(`import "c" for C` + "\n" + `class B {}`)},
+		"c.wren": {Data: []byte(`class C {}`)},
+	}
+	for _, limit := range []int{0, 3, 2} {
+		vm := wren.NewVM()
+		defer vm.Close()
+		vm.SetModuleFS(modules)
+		vm.SetMaxImportDepth(limit)
+		err := vm.Interpret(`import "a" for A`)
+		if limit == 2 {
+			if !errors.Is(err, wren.ErrImportDepth) || err.Error() != "import depth limit exceeded: main -> a -> b -> c" {
+				t.Errorf("unexpected error with a limit of %d: %v", limit, err)
+			}
+		} else if err != nil {
+			t.Errorf("unexpected error with a limit of %d: %v", limit, err)
+		}
+	}
+}
+
+func TestExposeEnv(t *testing.T) {
+	os.Setenv("GO_WREN_TEST_PUBLIC", "visible")
+	os.Setenv("GO_WREN_TEST_SECRET", "hidden")
+	defer os.Unsetenv("GO_WREN_TEST_PUBLIC")
+	defer os.Unsetenv("GO_WREN_TEST_SECRET")
+
+	vm := wren.NewVM()
+	defer vm.Close()
+	if err := vm.ExposeEnv("GO_WREN_TEST_PUBLIC", "GO_WREN_TEST_UNSET"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(`
+		class Go {
+			foreign static env(name)
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]interface{}{
+		"GO_WREN_TEST_PUBLIC": "visible",
+		"GO_WREN_TEST_SECRET": nil,
+		"GO_WREN_TEST_UNSET":  nil,
+	} {
+		value, err := vm.InterpretValue(`Go.env("` + name + `")`)
+		if err != nil {
+			t.Errorf("Go.env(%s) failed: %v", name, err)
+		} else if value != expected {
+			t.Errorf("Go.env(%s) returned %v, expected %v", name, value, expected)
+		}
+	}
+}
+
+func TestBytesAllocated(t *testing.T) {
+	vm := wren.NewVM()
+	initial := vm.BytesAllocated()
+	if initial <= 0 {
+		t.Fatalf("expected a new VM to have allocated memory, got %d", initial)
+	}
+
+	if err := vm.Interpret(`var big = (1..10000).toList`); err != nil {
+		t.Fatal(err)
+	}
+	grown := vm.BytesAllocated()
+	if grown < initial+10000*8 {
+		t.Errorf("expected allocating a big list to use more memory: %d -> %d", initial, grown)
+	}
+
+	if err := vm.Interpret(`big = null`); err != nil {
+		t.Fatal(err)
+	}
+	vm.GC()
+	if freed := vm.BytesAllocated(); freed >= grown {
+		t.Errorf("expected garbage collection to free memory: %d -> %d", grown, freed)
+	}
+
+	vm.Close()
+	if vm.BytesAllocated() != 0 {
+		t.Error("expected a closed VM to report no memory")
+	}
+}
+
+func TestGCHook(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	var observed []wren.VMStats
+	if err := vm.SetGCHook(func(stats wren.VMStats) {
+		observed = append(observed, stats)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := vm.Stats(); stats.Collections != 0 || stats.PeakBytesAllocated < stats.BytesAllocated {
+		t.Fatalf("unexpected initial stats: %+v", stats)
+	}
+
+	vm.GC()
+	if len(observed) != 1 || observed[0].Collections != 1 {
+		t.Fatalf("expected the hook to see one collection, got %+v", observed)
+	}
+
+	// Make enough garbage that Wren collects on its own.
+	if err := vm.Interpret(`
+		for (i in 1..1000000) {
+			var garbage = [i, i.toString]
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if len(observed) != 2 || observed[1].Collections != 2 {
+		t.Fatalf("expected the hook to see an automatic collection, got %+v", observed)
+	}
+	if stats := vm.Stats(); stats.PeakBytesAllocated <= stats.BytesAllocated {
+		t.Errorf("expected peak memory use to exceed current use after collecting: %+v", stats)
+	}
+}
+
+func TestReset(t *testing.T) {
+	var buf bytes.Buffer
+	vm := wren.NewVM()
+	defer vm.Close()
+	vm.SetOutputWriter(&buf)
+	if err := vm.RegisterForeignMethod("static GoReset.double(_)", func(n int) int {
+		return n * 2
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	const script = `
+		class GoReset {
+			foreign static double(n)
+		}
+		var x = GoReset.double(21)
+		System.print(x)
+	`
+	if err := vm.Interpret(script); err != nil {
+		t.Fatal(err)
+	}
+	x := vm.Variable("x")
+
+	if err := vm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the reset, redefining the class and variable would fail.
+	if err := vm.Interpret(script); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "42\n42\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+	if _, err := x.Call("toString"); err != wren.ErrClosed {
+		t.Errorf("expected a value from before the reset to fail, got %v", err)
+	}
+
+	// A new Wren virtual machine may well be allocated where an old one was freed,
+	// which mustn't make values from before the reset usable again.
+	for i := 0; i < 10; i++ {
+		if err := vm.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := x.Call("toString"); err != wren.ErrClosed {
+			t.Fatalf("expected a value from before reset %d to fail, got %v", i, err)
+		}
+	}
+	x = nil
+	runtime.GC()
+}
+
+func TestWrapFunc(t *testing.T) {
+	vm := wren.NewVM()
+	defer vm.Close()
+	wren.SetErrorWriter(ioutil.Discard)
+	defer wren.SetErrorWriter(nil)
+
+	if err := vm.Interpret(`
+		class Apply {
+			static map(list, f) { list.map(f).toList }
+			static call(f) { f.call() }
+			static call(f, a, b) { f.call(a, b) }
+			static try(f, a) { Fiber.new { f.call(a) }.try() }
+		}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	apply := vm.Variable("Apply")
+
+	double := vm.WrapFunc(func(x int) int { return x * 2 })
+	if result, err := apply.Call("map(_,_)", []int{1, 2, 3}, double); err != nil || fmt.Sprint(result) != "[2 4 6]" {
+		t.Errorf("map returned %v, %v", result, err)
+	}
+
+	called := false
+	if _, err := apply.Call("call(_)", vm.WrapFunc(func() { called = true })); err != nil || !called {
+		t.Errorf("calling a function with no arguments failed: %v", err)
+	}
+
+	join := vm.WrapFunc(func(sep string, parts ...string) string { return strings.Join(parts, sep) })
+	if result, err := apply.Call("call(_,_,_)", join, "-", "a"); err != nil || result != "a" {
+		t.Errorf("calling a variadic function returned %v, %v", result, err)
+	}
+
+	// Calling with the wrong number of arguments fails the fiber.
+	if result, err := apply.Call("call(_,_,_)", double, 1, 2); err == nil {
+		t.Errorf("calling with too many arguments returned %v", result)
+	}
+	if result, err := apply.Call("try(_,_)", double, "x"); err != nil || result == nil {
+		t.Errorf("expected a catchable error for a bad argument, got %v, %v", result, err)
 	}
 }